@@ -1,21 +1,24 @@
 package main
 
 import (
+	"context"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"github.com/mailgun/mailgun-go/v4"
 	mattermost "github.com/mattermost/mattermost-server/v6/model"
 	"github.com/unrolled/render"
 	"github.com/xanzy/go-gitlab"
 	janus "gitlab.operationuplift.work/operations/development/janus/lib"
 	"gitlab.operationuplift.work/operations/development/janus/lib/auth"
+	"gitlab.operationuplift.work/operations/development/janus/lib/mailer"
 	"gitlab.operationuplift.work/operations/development/janus/lib/provisioner"
 	"gitlab.operationuplift.work/operations/development/janus/lib/useradmin"
+	"gitlab.operationuplift.work/operations/development/janus/lib/webhook"
 )
 
 var (
@@ -31,8 +34,12 @@ var (
 	openIDScopes    = env("JANUS_OPENID_SCOPES", "email")
 	openIDCallback  = env("JANUS_OPENID_CALLBACK", "")
 	openIDDiscovery = env("JANUS_OPENID_DISCOVERY", "")
+	webhookSecret   = env("JANUS_WEBHOOK_SECRET", "" /*DO NOT PUT IT HERE!!*/)
+	webhookToken    = env("JANUS_WEBHOOK_TOKEN", "" /*DO NOT PUT IT HERE!!*/)
+	webhookWindow   = env("JANUS_WEBHOOK_REPLAY_WINDOW", "5m")
+	smtpPassword    = env("JANUS_SMTP_PASSWORD", "" /*DO NOT PUT IT HERE!!*/)
 
-	// MG_DOMAIN and MG_API_KEY also required for Mailgun.
+	// MG_DOMAIN and MG_API_KEY also required for the Mailgun email backend.
 )
 
 func main() {
@@ -67,11 +74,6 @@ func main() {
 		log.Printf("Connected to Gitlab version %v.", ver)
 	}
 
-	mgc, err := mailgun.NewMailgunFromEnv()
-	if err != nil {
-		log.Fatalf("Creating Mailgun client: %v", err)
-	}
-
 	rend := render.New(render.Options{
 		Layout:        "layout",
 		IsDevelopment: true,
@@ -87,21 +89,93 @@ func main() {
 	auth.RegisterRoutes(router)
 
 	config := janus.MustLoadConfig(configFile)
+	names := &provisioner.Resolver{
+		Mattermost: mmc,
+		Config:     config.Provisioner,
+	}
+	if err := names.Refresh(); err != nil {
+		log.Fatalf("Resolving Mattermost names: %v", err)
+	}
+	refresh := config.Provisioner.NameRefresh.Duration
+	if refresh <= 0 {
+		refresh = 10 * time.Minute
+	}
+	go names.Run(context.Background(), refresh)
+
+	mlr, err := mailer.New(config.Email, smtpPassword)
+	if err != nil {
+		log.Fatalf("Creating mailer: %v", err)
+	}
+	if smtp, ok := mlr.(*mailer.SMTP); ok {
+		if tmpl := config.Provisioner.WelcomeTemplate; tmpl != "" {
+			if err := smtp.CheckTemplate(tmpl, config.Provisioner.WelcomeVariableNames()); err != nil {
+				log.Fatalf("Checking welcome email template: %v", err)
+			}
+		}
+		if tmpl := config.Provisioner.Approval.RejectTemplate; tmpl != "" {
+			if err := smtp.CheckTemplate(tmpl, provisioner.RejectVariables); err != nil {
+				log.Fatalf("Checking rejection email template: %v", err)
+			}
+		}
+	}
+
 	prh := &provisioner.Handler{
 		Config:        config.Provisioner,
 		UseSSO:        true,
 		EmailFromAddr: emailFromAddr,
+		GitlabURL:     gitlabURL,
+		MattermostURL: mattermostURL,
 		Mattermost:    mmc,
 		Gitlab:        glc,
-		Mailgun:       mgc,
+		Mailer:        mlr,
+		Names:         names,
+	}
+	window, err := time.ParseDuration(webhookWindow)
+	if err != nil {
+		log.Fatalf("Parsing webhook replay window %q: %v", webhookWindow, err)
+	}
+	if webhookSecret == "" && webhookToken == "" {
+		log.Fatal("One of JANUS_WEBHOOK_SECRET and JANUS_WEBHOOK_TOKEN must be set.")
+	}
+	hook := &webhook.Config{
+		Secret:       webhookSecret,
+		Token:        webhookToken,
+		ReplayWindow: window,
+	}
+	router.POST("/user/provision/", webhook.Verify(hook, prh.Provision))
+	router.POST("/user/provision/plan", webhook.Verify(hook, prh.Plan))
+	router.GET("/user/provision/:id", webhook.Verify(hook, prh.Status))
+	router.POST("/user/offboard/", webhook.Verify(hook, prh.Offboard))
+	router.POST("/user/update/", webhook.Verify(hook, prh.Update))
+	router.POST("/user/intake/:profile", webhook.Verify(hook, prh.Provision))
+	router.POST("/user/intake/:profile/plan", webhook.Verify(hook, prh.Plan))
+
+	qcfg := config.Provisioner.Queue
+	if qcfg.File == "" {
+		qcfg.File = "./janus.db"
+	}
+	store, err := provisioner.OpenStore(qcfg.File)
+	if err != nil {
+		log.Fatalf("Opening job store %q: %v", qcfg.File, err)
+	}
+	defer store.Close()
+	prh.Jobs = provisioner.NewQueue(prh, store, qcfg)
+	if err := prh.Jobs.Start(context.Background()); err != nil {
+		log.Fatalf("Starting provisioning queue: %v", err)
+	}
+
+	reconciler := &provisioner.Reconciler{Handler: prh, Store: store}
+	if interval := config.Provisioner.Reconcile.Interval.Duration; interval > 0 {
+		go reconciler.Run(context.Background(), interval)
 	}
-	router.POST("/user/provision/", prh.Provision)
 
 	usradm := &useradmin.Handler{
 		Render:     rend,
 		Config:     config.UserAdmin,
 		Gitlab:     glc,
 		Mattermost: mmc,
+		Reconciler: reconciler,
+		Jobs:       prh.Jobs,
 	}
 	usradm.RegisterRoutes(router, "/user/admin")
 
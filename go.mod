@@ -9,6 +9,7 @@ require (
 	github.com/mattermost/mattermost-server/v6 v6.3.0
 	github.com/pelletier/go-toml/v2 v2.0.0-beta.6
 	github.com/unrolled/render v1.4.1
+	go.etcd.io/bbolt v1.3.6
 )
 
 require (
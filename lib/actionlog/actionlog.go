@@ -0,0 +1,53 @@
+// Package actionlog records the outcome of administrative actions on a set
+// of entities, for display in the useradmin/actionlog template or as JSON.
+package actionlog
+
+import "fmt"
+
+// Log is the outcome of an action on a set of entities.
+type Log struct {
+	Title    string    `json:"title"`
+	Entities []*Entity `json:"entities"`
+	RefURL   string    `json:"refURL,omitempty"`
+}
+
+// Entity is what happened to one of the entities.
+type Entity struct {
+	Name      string  `json:"name"`
+	HasErrors bool    `json:"hasErrors"`
+	Log       []Entry `json:"log"`
+}
+
+// Entry is a single info or error message.
+type Entry struct {
+	Type string `json:"type"` // "info" or "error".
+	Log  string `json:"log"`
+}
+
+// Addf adds an entity with the formatted name to the log and returns it.
+func (l *Log) Addf(namefmt string, args ...interface{}) *Entity {
+	res := &Entity{Name: fmt.Sprintf(namefmt, args...)}
+	l.Entities = append(l.Entities, res)
+	return res
+}
+
+// HasErrors reports whether any entity has errors.
+func (l *Log) HasErrors() bool {
+	for _, e := range l.Entities {
+		if e.HasErrors {
+			return true
+		}
+	}
+	return false
+}
+
+// Logf adds an info message.
+func (e *Entity) Logf(format string, args ...interface{}) {
+	e.Log = append(e.Log, Entry{"info", fmt.Sprintf(format, args...)})
+}
+
+// Errorf adds an error message and marks the entity as failed.
+func (e *Entity) Errorf(format string, args ...interface{}) {
+	e.Log = append(e.Log, Entry{"error", fmt.Sprintf(format, args...)})
+	e.HasErrors = true
+}
@@ -1,11 +1,14 @@
 package janus
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 
 	"github.com/pelletier/go-toml/v2"
+	"gitlab.operationuplift.work/operations/development/janus/lib/mailer"
 	"gitlab.operationuplift.work/operations/development/janus/lib/provisioner"
 	"gitlab.operationuplift.work/operations/development/janus/lib/useradmin"
 )
@@ -14,6 +17,7 @@ import (
 type Config struct {
 	Provisioner *provisioner.Config
 	UserAdmin   *useradmin.Config
+	Email       *mailer.Config
 }
 
 // MustLoadConfig loads a TOML-formatted configuration from the given file.
@@ -34,9 +38,23 @@ func LoadConfig(file string) (*Config, error) {
 	}
 
 	res := &Config{}
-	if err := toml.Unmarshal(data, &res); err != nil {
+	dec := toml.NewDecoder(bytes.NewReader(data)).SetStrict(true)
+	if err := dec.Decode(&res); err != nil {
+		var derr *toml.DecodeError
+		var serr *toml.StrictMissingError
+		switch {
+		case errors.As(err, &derr):
+			return nil, fmt.Errorf("decoding TOML:\n%s", derr.String())
+		case errors.As(err, &serr):
+			return nil, fmt.Errorf("decoding TOML:\n%s", serr.String())
+		}
 		return nil, fmt.Errorf("decoding TOML: %w", err)
 	}
 
+	if res.Provisioner != nil {
+		if err := res.Provisioner.Validate(); err != nil {
+			return nil, fmt.Errorf("provisioner: %w", err)
+		}
+	}
 	return res, nil
 }
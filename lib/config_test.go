@@ -1,9 +1,13 @@
 package janus
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/xanzy/go-gitlab"
+	"gitlab.operationuplift.work/operations/development/janus/lib/mailer"
 	"gitlab.operationuplift.work/operations/development/janus/lib/provisioner"
 	"gitlab.operationuplift.work/operations/development/janus/lib/useradmin"
 )
@@ -15,9 +19,23 @@ func TestLoadConfig(t *testing.T) {
 	}
 	want := &Config{
 		Provisioner: &provisioner.Config{
-			GitlabProject:          "some project",
-			GitlabGroup:            "some group",
+			GitlabProject: "some project",
+			GitlabGroup:   "some group",
+			Usernames: provisioner.UsernamePolicy{
+				Reserved: []string{"staff", "support"},
+				Suffix:   "-%d",
+			},
+			Announce: provisioner.AnnounceConfig{
+				Team:    "some team",
+				Channel: "onboarding",
+				Mention: []string{"ops"},
+			},
+			WelcomeTemplate:        "some template",
 			MailgunWelcomeTemplate: "some template",
+			WelcomeVariables: map[string]string{
+				"first":    "{{.FirstName}}",
+				"channels": `{{join .Channels ", "}}`,
+			},
 			Rules: []provisioner.Rule{
 				{
 					Name:     "first test entry",
@@ -30,6 +48,21 @@ func TestLoadConfig(t *testing.T) {
 					Skill:    "another skill",
 					Team:     "some team",
 					Channels: []string{"channel2", "channel3"},
+					Gitlab: []provisioner.GitlabGrant{
+						{Group: "some group", Access: provisioner.AccessLevel(gitlab.ReporterPermissions), Expires: "90d"},
+						{Project: "some/project", Access: provisioner.AccessLevel(gitlab.DeveloperPermissions)},
+					},
+				},
+				{
+					Name:         "third test entry",
+					AnySkills:    []string{"skill.*", "other"},
+					NotSkills:    []string{"excluded skill"},
+					IgnoreCase:   true,
+					Regex:        true,
+					EmailDomains: []string{"example.com"},
+					Priority:     10,
+					Stop:         true,
+					Team:         "other team",
 				},
 			},
 		},
@@ -39,8 +72,43 @@ func TestLoadConfig(t *testing.T) {
 				{Name: "helpdesk", GitlabID: 67},
 			},
 		},
+		Email: &mailer.Config{
+			Backend: "smtp",
+			SMTP: mailer.SMTPConfig{
+				Host:      "mail.example.com",
+				Port:      25,
+				Username:  "janus",
+				StartTLS:  true,
+				Templates: "./templates/email",
+			},
+		},
 	}
-	if diff := cmp.Diff(want, got); diff != "" {
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreUnexported(provisioner.Config{}, provisioner.Rule{}, provisioner.AnnounceConfig{}, provisioner.ChecklistConfig{})); diff != "" {
 		t.Error("Unexpected LoadConfig diff (-want +got):\n", diff)
 	}
 }
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, file string
+		want       []string // substrings of the error.
+	}{
+		{"unknown key", "./testdata/bad_unknown_key.toml", []string{`skils = ["some skill"]`, "missing field"}},
+		{"invalid regex", "./testdata/bad_regex.toml", []string{`rule #1 ("broken pattern")`, "anySkills[0]", `invalid pattern "(unclosed"`}},
+		{"no condition", "./testdata/bad_no_condition.toml", []string{`rule #1 ("matches nobody")`, "one of skill, anySkills, allSkills or emailDomains is required"}},
+		{"bad gitlab grant", "./testdata/bad_gitlab_grant.toml", []string{`access = "superuser"`, `unknown access level "superuser"`}},
+		{"unknown email data", "./testdata/bad_welcome_variables.toml", []string{"welcomeVariables.first", "can't evaluate field Firstname"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadConfig(tc.file)
+			if err == nil {
+				t.Fatalf("LoadConfig(%q) succeeded, want error", tc.file)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("LoadConfig(%q) error %q does not contain %q", tc.file, err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Package mailer sends templated emails through a configurable backend.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/mailgun/mailgun-go/v4"
+)
+
+// Message is an email rendered from a named template.
+type Message struct {
+	From      string
+	To        string
+	Subject   string
+	Template  string
+	Variables map[string]string
+}
+
+// Mailer sends emails.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// Config selects and configures the email backend.
+type Config struct {
+	Backend string // "mailgun" (the default) or "smtp".
+	SMTP    SMTPConfig
+}
+
+// New creates the mailer selected by the config. The SMTP password is
+// passed separately, as it does not belong in the config file.
+func New(cfg *Config, smtpPassword string) (Mailer, error) {
+	backend := "mailgun"
+	if cfg != nil && cfg.Backend != "" {
+		backend = cfg.Backend
+	}
+	switch backend {
+	case "mailgun":
+		// Requires MG_DOMAIN and MG_API_KEY.
+		mg, err := mailgun.NewMailgunFromEnv()
+		if err != nil {
+			return nil, fmt.Errorf("creating Mailgun client: %w", err)
+		}
+		return &Mailgun{Client: mg}, nil
+	case "smtp":
+		return NewSMTP(&cfg.SMTP, smtpPassword)
+	default:
+		return nil, fmt.Errorf("unknown email backend %q", backend)
+	}
+}
+
+// Mailgun sends emails through Mailgun, using templates stored on the
+// Mailgun side.
+type Mailgun struct {
+	Client mailgun.Mailgun
+}
+
+func (m *Mailgun) Send(ctx context.Context, msg *Message) error {
+	mgm := m.Client.NewMessage(msg.From, msg.Subject, "", msg.To)
+	mgm.SetTemplate(msg.Template)
+	for name, value := range msg.Variables {
+		if err := mgm.AddTemplateVariable(name, value); err != nil {
+			return fmt.Errorf("template variable %q: %w", name, err)
+		}
+	}
+	resp, id, err := m.Client.Send(ctx, mgm)
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Sent email through Mailgun (resp: %s, id: %s).", resp, id)
+	return nil
+}
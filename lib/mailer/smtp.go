@@ -0,0 +1,227 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// SMTPConfig configures the SMTP backend.
+//
+// Templates are read from the Templates directory: a template named
+// "welcome" consists of welcome.html.tmpl (html/template) and/or
+// welcome.txt.tmpl (text/template), executed on the message variables.
+type SMTPConfig struct {
+	Host      string
+	Port      int // defaults to 587.
+	Username  string
+	StartTLS  bool   // require STARTTLS before sending anything.
+	Templates string // defaults to ./templates/email.
+}
+
+// SMTP sends emails through an SMTP server, rendering templates locally.
+type SMTP struct {
+	cfg      SMTPConfig
+	password string
+	html     map[string]*htmltemplate.Template
+	text     map[string]*texttemplate.Template
+}
+
+// NewSMTP creates an SMTP mailer and loads its templates.
+func NewSMTP(cfg *SMTPConfig, password string) (*SMTP, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("smtp: host is required")
+	}
+	m := &SMTP{
+		cfg:      *cfg,
+		password: password,
+		html:     map[string]*htmltemplate.Template{},
+		text:     map[string]*texttemplate.Template{},
+	}
+	if m.cfg.Port == 0 {
+		m.cfg.Port = 587
+	}
+	if m.cfg.Templates == "" {
+		m.cfg.Templates = "./templates/email"
+	}
+
+	files, err := os.ReadDir(m.cfg.Templates)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: reading templates: %w", err)
+	}
+	for _, f := range files {
+		path := filepath.Join(m.cfg.Templates, f.Name())
+		switch name := f.Name(); {
+		case strings.HasSuffix(name, ".html.tmpl"):
+			t, err := htmltemplate.ParseFiles(path)
+			if err != nil {
+				return nil, fmt.Errorf("smtp: %w", err)
+			}
+			m.html[strings.TrimSuffix(name, ".html.tmpl")] = t.Option("missingkey=error")
+		case strings.HasSuffix(name, ".txt.tmpl"):
+			t, err := texttemplate.ParseFiles(path)
+			if err != nil {
+				return nil, fmt.Errorf("smtp: %w", err)
+			}
+			m.text[strings.TrimSuffix(name, ".txt.tmpl")] = t.Option("missingkey=error")
+		}
+	}
+	return m, nil
+}
+
+// HasTemplate reports whether a template with the given name was loaded.
+func (m *SMTP) HasTemplate(name string) bool {
+	return m.html[name] != nil || m.text[name] != nil
+}
+
+// CheckTemplate renders the named template with placeholders for the given
+// variables, so that templates using any other variable are caught before
+// the first email is sent.
+func (m *SMTP) CheckTemplate(name string, variables []string) error {
+	if !m.HasTemplate(name) {
+		return fmt.Errorf("template %q not found", name)
+	}
+	vars := map[string]string{}
+	for _, v := range variables {
+		vars[v] = v
+	}
+	_, err := m.render(&Message{Template: name, Variables: vars})
+	return err
+}
+
+func (m *SMTP) Send(ctx context.Context, msg *Message) error {
+	body, err := m.render(msg)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port))
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp handshake: %w", err)
+	}
+	defer c.Close()
+
+	if m.cfg.StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("server does not support STARTTLS")
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: m.cfg.Host}); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+	if m.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.cfg.Username, m.password, m.cfg.Host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	if err := c.Mail(msg.From); err != nil {
+		return fmt.Errorf("mail from: %w", err)
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("rcpt to: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+	if _, err := w.Write(body); err != nil {
+		return fmt.Errorf("writing message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("writing message: %w", err)
+	}
+	if err := c.Quit(); err != nil {
+		return fmt.Errorf("quit: %w", err)
+	}
+	log.Printf("[INFO] Sent email %q to %s through %s.", msg.Template, msg.To, addr)
+	return nil
+}
+
+// render builds the full MIME message, with a text and/or an HTML part.
+func (m *SMTP) render(msg *Message) ([]byte, error) {
+	htmlTmpl, textTmpl := m.html[msg.Template], m.text[msg.Template]
+	if htmlTmpl == nil && textTmpl == nil {
+		return nil, fmt.Errorf("unknown template %q", msg.Template)
+	}
+	// Line breaks would let a header value inject headers of its own.
+	for _, h := range []struct{ name, value string }{
+		{"from", msg.From},
+		{"to", msg.To},
+		{"subject", msg.Subject},
+	} {
+		if strings.ContainsAny(h.value, "\r\n") {
+			return nil, fmt.Errorf("%s must not contain line breaks", h.name)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", msg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+	// Parts go from least to most preferred.
+	if textTmpl != nil {
+		if err := writePart(mw, "text/plain", func(w *bytes.Buffer) error {
+			return textTmpl.Execute(w, msg.Variables)
+		}); err != nil {
+			return nil, fmt.Errorf("rendering text template %q: %w", msg.Template, err)
+		}
+	}
+	if htmlTmpl != nil {
+		if err := writePart(mw, "text/html", func(w *bytes.Buffer) error {
+			return htmlTmpl.Execute(w, msg.Variables)
+		}); err != nil {
+			return nil, fmt.Errorf("rendering HTML template %q: %w", msg.Template, err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writePart(mw *multipart.Writer, contentType string, render func(*bytes.Buffer) error) error {
+	var content bytes.Buffer
+	if err := render(&content); err != nil {
+		return err
+	}
+	w, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=utf-8"},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content.Bytes())
+	return err
+}
@@ -0,0 +1,92 @@
+package mailer
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSMTPRender(t *testing.T) {
+	m, err := NewSMTP(&SMTPConfig{Host: "localhost", Templates: "testdata"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasTemplate("hello") || m.HasTemplate("missing") {
+		t.Errorf("HasTemplate: wrong result")
+	}
+	if err := m.CheckTemplate("hello", []string{"name", "reason"}); err != nil {
+		t.Errorf("CheckTemplate with all variables: %v", err)
+	}
+	if err := m.CheckTemplate("hello", []string{"first_name"}); err == nil {
+		t.Errorf("CheckTemplate with a missing variable: got no error")
+	}
+	if err := m.CheckTemplate("missing", nil); err == nil {
+		t.Errorf("CheckTemplate of an unknown template: got no error")
+	}
+
+	data, err := m.render(&Message{
+		From:      "janus@example.com",
+		To:        "ada@example.com",
+		Subject:   "Hello",
+		Template:  "hello",
+		Variables: map[string]string{"name": "<Ada>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("To"); got != "ada@example.com" {
+		t.Errorf("To = %q, want ada@example.com", got)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, %v", mediaType, err)
+	}
+
+	got := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(part)
+		got[part.Header.Get("Content-Type")] = string(body)
+	}
+	want := map[string]string{
+		"text/plain; charset=utf-8": "Hi <Ada>!\n",
+		"text/html; charset=utf-8":  "<p>Hi &lt;Ada&gt;!</p>\n",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parts mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := m.render(&Message{Template: "missing"}); err == nil {
+		t.Errorf("render with an unknown template: got no error")
+	}
+	if _, err := m.render(&Message{Template: "hello"}); err == nil {
+		t.Errorf("render with a missing variable: got no error")
+	}
+	for _, msg := range []*Message{
+		{From: "janus@example.com\r\nBcc: eve@example.com", To: "ada@example.com", Subject: "Hello"},
+		{From: "janus@example.com", To: "ada@example.com\nBcc: eve@example.com", Subject: "Hello"},
+		{From: "janus@example.com", To: "ada@example.com", Subject: "Hello\r\nBcc: eve@example.com"},
+	} {
+		msg.Template = "hello"
+		msg.Variables = map[string]string{"name": "Ada"}
+		if _, err := m.render(msg); err == nil {
+			t.Errorf("render with a line break in a header (%+v): got no error", msg)
+		}
+	}
+}
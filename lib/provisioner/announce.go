@@ -0,0 +1,135 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	mattermost "github.com/mattermost/mattermost-server/v6/model"
+)
+
+// AnnounceConfig configures the announcement of provisioning outcomes in a
+// Mattermost channel.
+type AnnounceConfig struct {
+	Team    string // team of the channel (name or ID).
+	Channel string // channel to post in (name or ID). Unset disables announcements.
+
+	// Template renders the message from an AnnounceData. If unset,
+	// defaultAnnounceTemplate is used.
+	Template string
+
+	// Mention lists the users and groups mentioned when provisioning fails,
+	// like "@jane" or "@ops".
+	Mention []string
+
+	tmpl *template.Template // set by Validate.
+}
+
+// AnnounceData is what the announcement template is executed on.
+type AnnounceData struct {
+	JobID    uint64
+	Name     string
+	Username string // empty if provisioning failed before a username was chosen.
+	Email    string
+
+	Rules    []string // names of the rules matching the user.
+	Teams    []string // Mattermost teams granted by the rules.
+	Channels []string // Mattermost channels granted by the rules.
+
+	Failed   bool
+	Errors   []string // why provisioning failed, and undo actions that failed.
+	Mentions string   // the configured mentions if provisioning failed, space separated.
+}
+
+const defaultAnnounceTemplate = `{{if .Failed -}}
+:x: Provisioning {{.Name}} ({{.Email}}) failed. {{.Mentions}}
+{{range .Errors}}* {{.}}
+{{end}}
+{{- else -}}
+:wave: {{.Name}} joined as @{{.Username}}.
+{{- if .Rules}}
+Rules: {{join .Rules ", "}}{{end}}
+{{- if .Channels}}
+Channels: {{join .Channels ", "}}{{end}}
+{{- end}}`
+
+// compile parses the announcement template, or the default one.
+func (ac *AnnounceConfig) compile() error {
+	if ac.Channel == "" {
+		return nil
+	}
+	if ac.Team == "" {
+		return errors.New("team is required")
+	}
+	text := ac.Template
+	if text == "" {
+		text = defaultAnnounceTemplate
+	}
+	tmpl, err := compileTemplate("announce", text, &AnnounceData{
+		Rules:    []string{"rule"},
+		Teams:    []string{"team"},
+		Channels: []string{"channel"},
+		Errors:   []string{"error"},
+	})
+	if err != nil {
+		return fmt.Errorf("template: %w", err)
+	}
+	ac.tmpl = tmpl
+	return nil
+}
+
+// announceData collects what the announcement reports about a finished
+// provisioning run. p is nil if the run failed before it was planned.
+func (h *Handler) announceData(job *Job, p *Plan, res *Result) *AnnounceData {
+	data := &AnnounceData{
+		JobID: job.ID,
+		Name:  job.Payload.Name,
+		Email: job.Payload.Email,
+	}
+	if p != nil {
+		data.Username = p.Username
+		for _, r := range p.Rules {
+			data.Rules = append(data.Rules, r.Name)
+		}
+		for _, tg := range p.Teams {
+			data.Teams = append(data.Teams, tg.Team)
+			for _, cg := range tg.Channels {
+				data.Channels = append(data.Channels, cg.Channel)
+			}
+		}
+	}
+	if res.Error != "" {
+		data.Failed = true
+		data.Errors = append([]string{res.Error}, res.RollbackErrors...)
+		var mentions []string
+		for _, m := range h.Config.Announce.Mention {
+			mentions = append(mentions, "@"+strings.TrimPrefix(m, "@"))
+		}
+		data.Mentions = strings.Join(mentions, " ")
+	}
+	return data
+}
+
+// announce posts the outcome of a finished provisioning run in the
+// configured channel.
+func (h *Handler) announce(data *AnnounceData) error {
+	ac := &h.Config.Announce
+	var sb strings.Builder
+	if err := ac.tmpl.Execute(&sb, data); err != nil {
+		return fmt.Errorf("rendering announcement: %w", err)
+	}
+	teamID, err := h.Names.Team(ac.Team)
+	if err != nil {
+		return err
+	}
+	channelID, err := h.Names.Channel(teamID, ac.Channel)
+	if err != nil {
+		return err
+	}
+	_, _, err = h.Mattermost.CreatePost(&mattermost.Post{
+		ChannelId: channelID,
+		Message:   sb.String(),
+	})
+	return err
+}
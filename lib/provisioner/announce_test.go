@@ -0,0 +1,81 @@
+package provisioner
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAnnounceMessage(t *testing.T) {
+	h := &Handler{Config: &Config{
+		Announce: AnnounceConfig{
+			Team:    "ops",
+			Channel: "onboarding",
+			Mention: []string{"ops", "@jane"},
+		},
+	}}
+	if err := h.Config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	job := &Job{ID: 7, Payload: &OnboardingUser{Name: "Joe Bloggs", Email: "joe@example.com"}}
+	p := &Plan{
+		Username: "joe",
+		Rules:    []RuleMatch{{Name: "devs"}, {Name: "ops"}},
+		Teams: []TeamGrant{
+			{Team: "dev", Channels: []ChannelGrant{{Channel: "backend"}, {Channel: "frontend"}}},
+		},
+	}
+
+	for _, tc := range []struct {
+		name string
+		p    *Plan
+		res  *Result
+		want string
+	}{
+		{
+			name: "success",
+			p:    p,
+			res:  &Result{},
+			want: ":wave: Joe Bloggs joined as @joe.\nRules: devs, ops\nChannels: backend, frontend",
+		},
+		{
+			name: "failure",
+			p:    p,
+			res:  &Result{Error: "mattermost: boom", RollbackErrors: []string{"gitlab: delete user: nope"}},
+			want: ":x: Provisioning Joe Bloggs (joe@example.com) failed. @ops @jane\n* mattermost: boom\n* gitlab: delete user: nope\n",
+		},
+		{
+			name: "failure before planning",
+			res:  &Result{Error: "planning: bad name"},
+			want: ":x: Provisioning Joe Bloggs (joe@example.com) failed. @ops @jane\n* planning: bad name\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sb strings.Builder
+			if err := h.Config.Announce.tmpl.Execute(&sb, h.announceData(job, tc.p, tc.res)); err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, sb.String()); diff != "" {
+				t.Error("Unexpected message diff (-want +got):\n", diff)
+			}
+		})
+	}
+}
+
+func TestAnnounceConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ac   AnnounceConfig
+	}{
+		{"missing team", AnnounceConfig{Channel: "onboarding"}},
+		{"bad template", AnnounceConfig{Team: "ops", Channel: "onboarding", Template: "{{.Name"}},
+		{"unknown field", AnnounceConfig{Team: "ops", Channel: "onboarding", Template: "{{.Nickname}}"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.ac.compile(); err == nil {
+				t.Error("compile succeeded, want error")
+			}
+		})
+	}
+}
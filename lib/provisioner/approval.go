@@ -0,0 +1,126 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gitlab.operationuplift.work/operations/development/janus/lib/mailer"
+)
+
+// ApprovalConfig configures the review of onboarding requests before any
+// account is created.
+type ApprovalConfig struct {
+	// Required holds every request for approval. Without it, only requests
+	// matching a rule with RequireApproval are held.
+	Required bool
+
+	// RejectTemplate names the email template sent to rejected applicants,
+	// if the reviewer chooses to notify them. It gets the name, first_name
+	// and reason variables. If unset, applicants cannot be notified.
+	RejectTemplate string
+
+	// RejectSubject is the subject of the rejection email.
+	RejectSubject string
+}
+
+// RejectVariables are the variables of the rejection email.
+var RejectVariables = []string{"name", "first_name", "reason"}
+
+// needsApproval reports whether a request must be approved before it is
+// provisioned.
+func (c *Config) needsApproval(u *OnboardingUser) bool {
+	if c.Approval.Required {
+		return true
+	}
+	for _, r := range c.MatchingRules(u) {
+		if r.RequireApproval {
+			return true
+		}
+	}
+	return false
+}
+
+// Approve queues a job awaiting approval for provisioning.
+func (q *Queue) Approve(id uint64, by string) (*Job, error) {
+	now := time.Now()
+	job, err := q.Store.update(id, func(job *Job) error {
+		if job.State != JobAwaitingApproval {
+			return fmt.Errorf("job %d is %s: %w", id, job.State, ErrNotAwaitingApproval)
+		}
+		job.State = JobPending
+		job.NextAttempt = now
+		job.Review = &Review{By: by, At: now, Approved: true}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] Provisioning job %d for %s approved by %s.", job.ID, job.Payload.Email, by)
+	q.notify()
+	return job, nil
+}
+
+// Reject rejects a job awaiting approval, and emails the applicant about it
+// if notify is set. The job is rejected even if the email cannot be sent.
+func (q *Queue) Reject(ctx context.Context, id uint64, by, reason string, notify bool) (*Job, error) {
+	h := q.Handler
+	if notify && h.Config.Approval.RejectTemplate == "" {
+		return nil, fmt.Errorf("cannot notify applicant: no rejection email template configured")
+	}
+	now := time.Now()
+	job, err := q.Store.update(id, func(job *Job) error {
+		if job.State != JobAwaitingApproval {
+			return fmt.Errorf("job %d is %s: %w", id, job.State, ErrNotAwaitingApproval)
+		}
+		job.State = JobRejected
+		job.Review = &Review{By: by, At: now, Reason: reason}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] Provisioning job %d for %s rejected by %s: %s", job.ID, job.Payload.Email, by, reason)
+	if !notify {
+		return job, nil
+	}
+
+	if err := h.sendRejectionEmail(ctx, job.Payload, reason); err != nil {
+		return job, fmt.Errorf("sending rejection email: %w", err)
+	}
+	job, err = q.Store.update(id, func(job *Job) error {
+		job.Review.Notified = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storing job: %w", err)
+	}
+	return job, nil
+}
+
+func (h *Handler) sendRejectionEmail(ctx context.Context, u *OnboardingUser, reason string) error {
+	first, _, _ := splitName(u.Name)
+	if first == "" {
+		// Like in the welcome email, one-word names are used whole.
+		first = strings.TrimSpace(u.Name)
+	}
+	subject := h.Config.Approval.RejectSubject
+	if subject == "" {
+		subject = "Your application"
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return h.Mailer.Send(ctx, &mailer.Message{
+		From:     h.EmailFromAddr,
+		To:       u.Email,
+		Subject:  subject,
+		Template: h.Config.Approval.RejectTemplate,
+		Variables: map[string]string{
+			"name":       strings.TrimSpace(u.Name),
+			"first_name": first,
+			"reason":     reason,
+		},
+	})
+}
@@ -0,0 +1,109 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gitlab.operationuplift.work/operations/development/janus/lib/mailer"
+)
+
+type fakeMailer struct {
+	sent []*mailer.Message
+}
+
+func (m *fakeMailer) Send(_ context.Context, msg *mailer.Message) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestApproval(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "janus.db"))
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	defer s.Close()
+
+	m := &fakeMailer{}
+	h := &Handler{
+		EmailFromAddr: "janus@example.com",
+		Mailer:        m,
+		Config: &Config{
+			Approval: ApprovalConfig{RejectTemplate: "rejected"},
+			Rules: []Rule{
+				{Name: "coders", Skill: "Programming"},
+				{Name: "outsiders", EmailDomains: []string{"example.net"}, RequireApproval: true},
+			},
+		},
+	}
+	if err := h.Config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	q := NewQueue(h, s, QueueConfig{})
+
+	enqueue := func(name, email string) *Job {
+		t.Helper()
+		job, err := q.Enqueue(&OnboardingUser{Name: name, Email: email, RawSkills: "Programming"})
+		if err != nil {
+			t.Fatalf("Enqueue(%s) failed: %v", email, err)
+		}
+		return job
+	}
+	if job := enqueue("Jane Doe", "jim@example.com"); job.State != JobPending {
+		t.Errorf("Enqueue without approval: got state %s, want %s", job.State, JobPending)
+	}
+	approved := enqueue("Jane Doe", "jane@example.net")
+	rejected := enqueue("Jane Doe", "joe@example.net")
+	oneWord := enqueue("Cher", "cher@example.net")
+	if approved.State != JobAwaitingApproval {
+		t.Fatalf("Enqueue with approval: got state %s, want %s", approved.State, JobAwaitingApproval)
+	}
+
+	job, err := q.Approve(approved.ID, "boss")
+	if err != nil {
+		t.Fatalf("Approve failed: %v", err)
+	}
+	if job.State != JobPending || job.Review == nil || !job.Review.Approved || job.Review.By != "boss" {
+		t.Errorf("Approve: got state %s, review %+v; want pending, approved by boss", job.State, job.Review)
+	}
+	if _, err := q.Approve(approved.ID, "boss"); !errors.Is(err, ErrNotAwaitingApproval) {
+		t.Errorf("second Approve: got %v, want ErrNotAwaitingApproval", err)
+	}
+
+	job, err = q.Reject(context.Background(), rejected.ID, "boss", "duplicate", true)
+	if err != nil {
+		t.Fatalf("Reject failed: %v", err)
+	}
+	if job.State != JobRejected || job.Review.Reason != "duplicate" || !job.Review.Notified {
+		t.Errorf("Reject: got state %s, review %+v; want rejected for duplicate, notified", job.State, job.Review)
+	}
+	if _, err := q.Reject(context.Background(), oneWord.ID, "boss", "duplicate", true); err != nil {
+		t.Fatalf("Reject of a one-word name failed: %v", err)
+	}
+	want := []*mailer.Message{{
+		From:     "janus@example.com",
+		To:       "joe@example.net",
+		Subject:  "Your application",
+		Template: "rejected",
+		Variables: map[string]string{
+			"name":       "Jane Doe",
+			"first_name": "Jane",
+			"reason":     "duplicate",
+		},
+	}, {
+		From:     "janus@example.com",
+		To:       "cher@example.net",
+		Subject:  "Your application",
+		Template: "rejected",
+		Variables: map[string]string{
+			"name":       "Cher",
+			"first_name": "Cher",
+			"reason":     "duplicate",
+		},
+	}}
+	if diff := cmp.Diff(want, m.sent); diff != "" {
+		t.Error("Unexpected emails diff (-want +got):\n", diff)
+	}
+}
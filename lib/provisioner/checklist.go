@@ -0,0 +1,249 @@
+package provisioner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// ChecklistConfig configures the onboarding checklist issue opened in Gitlab
+// for every new member.
+type ChecklistConfig struct {
+	Project string // Gitlab project (path or ID) to open issues in. Unset disables checklists.
+
+	// Title and Template render the issue title and its Markdown description
+	// from a ChecklistData. If unset, defaultChecklistTitle and
+	// defaultChecklistTemplate are used.
+	Title    string
+	Template string
+
+	// Labels are added to the issue, along with one per skill of the user.
+	Labels []string
+
+	title, tmpl *template.Template // set by Validate.
+}
+
+// ChecklistData is what the checklist templates are executed on.
+type ChecklistData struct {
+	EmailData
+
+	Skills []string // the user's skills.
+
+	// Rules lists the matching rules that have something for the user to do.
+	Rules []ChecklistRule
+}
+
+// ChecklistRule is what a matching rule asks of a new member.
+type ChecklistRule struct {
+	Name     string
+	Channels []ChecklistLink // Mattermost channels to read.
+	Groups   []ChecklistLink // Gitlab groups to look around.
+	Projects []ChecklistLink // Gitlab projects to clone.
+	People   []string        // people to meet.
+	Tasks    []string        // further items, in Markdown.
+}
+
+// ChecklistLink is a Mattermost channel or a Gitlab group or project.
+type ChecklistLink struct {
+	Name string
+	URL  string // empty if unknown.
+}
+
+// String formats the link in Markdown.
+func (l ChecklistLink) String() string {
+	if l.URL == "" {
+		return l.Name
+	}
+	return fmt.Sprintf("[%s](%s)", l.Name, l.URL)
+}
+
+// ChecklistIssue is the checklist issue a plan opens.
+type ChecklistIssue struct {
+	Project     string   `json:"project"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Labels      []string `json:"labels,omitempty"`
+}
+
+const defaultChecklistTitle = `Onboarding {{.Name}} (@{{.Username}})`
+
+const defaultChecklistTemplate = `Welcome, {{.FirstName}}! Tick these off as you get started.
+
+- [ ] Set your password at {{.PasswordURL}}
+- [ ] Log in to Mattermost at {{.MattermostURL}}
+{{- range .Rules}}
+
+### {{.Name}}
+{{range .Channels}}
+- [ ] Read {{.}}
+{{- end}}
+{{- range .Groups}}
+- [ ] Look around {{.}}
+{{- end}}
+{{- range .Projects}}
+- [ ] Clone {{.}}
+{{- end}}
+{{- range .People}}
+- [ ] Meet {{.}}
+{{- end}}
+{{- range .Tasks}}
+- [ ] {{.}}
+{{- end}}
+{{- end}}
+`
+
+// compile parses the checklist title and description templates, or the
+// default ones.
+func (cc *ChecklistConfig) compile() error {
+	if cc.Project == "" {
+		return nil
+	}
+	title, text := cc.Title, cc.Template
+	if title == "" {
+		title = defaultChecklistTitle
+	}
+	if text == "" {
+		text = defaultChecklistTemplate
+	}
+	sample := &ChecklistData{
+		EmailData: sampleEmailData,
+		Skills:    []string{"skill"},
+		Rules: []ChecklistRule{{
+			Name:     "rule",
+			Channels: []ChecklistLink{{Name: "channel"}},
+			Groups:   []ChecklistLink{{Name: "group"}},
+			Projects: []ChecklistLink{{Name: "project"}},
+			People:   []string{"@someone"},
+			Tasks:    []string{"task"},
+		}},
+	}
+	var err error
+	for _, t := range []struct {
+		field, text string
+		dst         **template.Template
+	}{
+		{"title", title, &cc.title},
+		{"template", text, &cc.tmpl},
+	} {
+		if *t.dst, err = compileTemplate("checklist", t.text, sample); err != nil {
+			return fmt.Errorf("%s: %w", t.field, err)
+		}
+	}
+	return nil
+}
+
+// checklistData collects the data available to the checklist templates.
+func (h *Handler) checklistData(p *Plan, payload *OnboardingUser, rules []Rule) *ChecklistData {
+	data := &ChecklistData{
+		EmailData: *h.emailData(p),
+		Skills:    payload.Skills(),
+	}
+	mattermostURL := strings.TrimSuffix(h.MattermostURL, "/")
+	gitlabURL := strings.TrimSuffix(h.GitlabURL, "/")
+	for _, r := range rules {
+		cr := ChecklistRule{Name: r.Name, People: r.Meet, Tasks: r.Tasks}
+		if r.Team != "" {
+			for _, tg := range p.Teams {
+				if tg.Team != r.Team {
+					continue
+				}
+				teamURL := mattermostURL + "/" + h.Names.URLName(tg.TeamID)
+				for _, cg := range tg.Channels {
+					if has(r.Channels, cg.Channel) {
+						cr.Channels = append(cr.Channels, ChecklistLink{
+							Name: "~" + h.Names.URLName(cg.ID),
+							URL:  teamURL + "/channels/" + h.Names.URLName(cg.ID),
+						})
+					}
+				}
+			}
+		}
+		for _, g := range r.Gitlab {
+			if g.Group != "" {
+				link := ChecklistLink{Name: g.Group}
+				if _, err := strconv.Atoi(g.Group); err != nil {
+					link.URL = gitlabURL + "/" + g.Group
+				}
+				cr.Groups = append(cr.Groups, link)
+				continue
+			}
+			link := ChecklistLink{Name: g.Project, URL: gitlabURL + "/" + g.Project}
+			if _, err := strconv.Atoi(g.Project); err == nil {
+				link.URL = gitlabURL + "/projects/" + g.Project
+			}
+			cr.Projects = append(cr.Projects, link)
+		}
+		if len(cr.Channels)+len(cr.Groups)+len(cr.Projects)+len(cr.People)+len(cr.Tasks) > 0 {
+			data.Rules = append(data.Rules, cr)
+		}
+	}
+	return data
+}
+
+// checklistIssue renders the checklist issue for the plan, or returns nil if
+// checklists are disabled.
+func (h *Handler) checklistIssue(p *Plan, payload *OnboardingUser, rules []Rule) (*ChecklistIssue, error) {
+	cc := &h.Config.Checklist
+	if cc.Project == "" {
+		return nil, nil
+	}
+	data := h.checklistData(p, payload, rules)
+	var title, description strings.Builder
+	if err := cc.title.Execute(&title, data); err != nil {
+		return nil, fmt.Errorf("rendering checklist title: %w", err)
+	}
+	if err := cc.tmpl.Execute(&description, data); err != nil {
+		return nil, fmt.Errorf("rendering checklist: %w", err)
+	}
+	issue := &ChecklistIssue{
+		Project:     cc.Project,
+		Title:       strings.TrimSpace(title.String()),
+		Description: description.String(),
+		Labels:      append([]string(nil), cc.Labels...),
+	}
+	for _, skill := range data.Skills {
+		if !has(issue.Labels, skill) {
+			issue.Labels = append(issue.Labels, skill)
+		}
+	}
+	return issue, nil
+}
+
+// setChecklistURL records the URL of the open checklist issue in the plan,
+// and renders the welcome email variables again to include it.
+func (h *Handler) setChecklistURL(p *Plan, url string) error {
+	p.ChecklistURL = url
+	vars, err := h.emailVariables(p)
+	if err != nil {
+		return err
+	}
+	p.EmailVariables = vars
+	return nil
+}
+
+// openChecklist opens the checklist issue, assigned to the user, and returns
+// its URL.
+func (h *Handler) openChecklist(ci *ChecklistIssue, uid int, tx *txn) (string, error) {
+	var url string
+	err := tx.do(fmt.Sprintf("gitlab: open checklist issue in %q", ci.Project), func() (func() error, error) {
+		labels := gitlab.Labels(ci.Labels)
+		issue, _, err := h.Gitlab.Issues.CreateIssue(ci.Project, &gitlab.CreateIssueOptions{
+			Title:       gitlab.String(ci.Title),
+			Description: gitlab.String(ci.Description),
+			AssigneeIDs: &[]int{uid},
+			Labels:      &labels,
+		})
+		if err != nil {
+			return nil, err
+		}
+		url = issue.WebURL
+		return func() error {
+			_, err := h.Gitlab.Issues.DeleteIssue(ci.Project, issue.IID)
+			return err
+		}, nil
+	})
+	return url, err
+}
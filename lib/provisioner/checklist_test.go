@@ -0,0 +1,75 @@
+package provisioner
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestChecklistIssue(t *testing.T) {
+	h := &Handler{
+		GitlabURL:     "https://gitlab.example.com/",
+		MattermostURL: "https://chat.example.com",
+		lookupUsername: func(username, email string) (bool, error) {
+			return false, nil
+		},
+	}
+	h.Config = &Config{
+		WelcomeVariables: map[string]string{"checklist": "{{.ChecklistURL}}"},
+		Checklist: ChecklistConfig{
+			Project: "onboarding/checklists",
+			Labels:  []string{"onboarding"},
+		},
+		Rules: []Rule{
+			{Name: "coders", Skill: "Programming", Team: "team1", Channels: []string{"dev"}, Meet: []string{"@jane"}, Gitlab: []GitlabGrant{
+				{Project: "code/janus"},
+				{Group: "code"},
+			}},
+			{Name: "analysts", Skill: "Data analysis", Tasks: []string{"Read the [data handbook](https://example.com/data)"}},
+			{Name: "everyone", Skill: "Design", Team: "team1"},
+		},
+	}
+	if err := h.Config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	p, err := h.plan(&OnboardingUser{
+		TelegramHandle: "jdoe",
+		Name:           "John Doe",
+		Email:          "john@example.com",
+		RawSkills:      "Programming, Data analysis, Design",
+	})
+	if err != nil {
+		t.Fatalf("plan failed: %v", err)
+	}
+	want := &ChecklistIssue{
+		Project: "onboarding/checklists",
+		Title:   "Onboarding John Doe (@jdoe)",
+		Description: `Welcome, John! Tick these off as you get started.
+
+- [ ] Set your password at https://gitlab.example.com/users/password/new
+- [ ] Log in to Mattermost at https://chat.example.com/login
+
+### coders
+
+- [ ] Read [~dev](https://chat.example.com/team1/channels/dev)
+- [ ] Look around [code](https://gitlab.example.com/code)
+- [ ] Clone [code/janus](https://gitlab.example.com/code/janus)
+- [ ] Meet @jane
+
+### analysts
+
+- [ ] Read the [data handbook](https://example.com/data)
+`,
+		Labels: []string{"onboarding", "Programming", "Data analysis", "Design"},
+	}
+	if diff := cmp.Diff(want, p.Checklist); diff != "" {
+		t.Error("Unexpected checklist issue diff (-want +got):\n", diff)
+	}
+
+	if err := h.setChecklistURL(p, "https://gitlab.example.com/onboarding/checklists/-/issues/1"); err != nil {
+		t.Fatalf("setChecklistURL failed: %v", err)
+	}
+	if got, want := p.EmailVariables["checklist"], "https://gitlab.example.com/onboarding/checklists/-/issues/1"; got != want {
+		t.Errorf("checklist email variable = %q, want %q", got, want)
+	}
+}
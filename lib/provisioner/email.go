@@ -0,0 +1,129 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// EmailData is what the welcome email variable templates are executed on.
+type EmailData struct {
+	Name      string
+	FirstName string
+	LastName  string
+	Username  string
+	Email     string
+
+	GitlabURL     string // Gitlab login page.
+	MattermostURL string // Mattermost login page.
+	PasswordURL   string // where the user sets their password.
+	ChecklistURL  string // the onboarding checklist issue, once it is open.
+
+	Teams    []string // Mattermost teams the user was added to.
+	Channels []string // Mattermost channels the user was added to.
+	Rules    []string // names of the rules matching the user.
+}
+
+var emailFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// sampleEmailData stands in for real data when templates are checked.
+var sampleEmailData = EmailData{
+	Teams:    []string{"team"},
+	Channels: []string{"channel"},
+	Rules:    []string{"rule"},
+}
+
+// compileTemplate parses a template with the email functions, and executes
+// it on sample data so that templates using data that does not exist fail
+// when the config is loaded rather than when they are first rendered.
+func compileTemplate(name, text string, sample interface{}) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(emailFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(&strings.Builder{}, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// compileWelcomeVariables parses the welcome email variable templates.
+func (c *Config) compileWelcomeVariables() error {
+	if c.WelcomeTemplate == "" {
+		c.WelcomeTemplate = c.MailgunWelcomeTemplate
+	}
+	if c.WelcomeTemplate != "" && len(c.WelcomeVariables) == 0 {
+		return errors.New("welcomeVariables: required when a welcome template is set")
+	}
+	c.welcomeVars = map[string]*template.Template{}
+	for _, name := range sortedKeys(c.WelcomeVariables) {
+		tmpl, err := compileTemplate(name, c.WelcomeVariables[name], &sampleEmailData)
+		if err != nil {
+			return fmt.Errorf("welcomeVariables.%s: %w", name, err)
+		}
+		c.welcomeVars[name] = tmpl
+	}
+	return nil
+}
+
+// WelcomeVariableNames returns the names of the welcome email variables, in
+// order.
+func (c *Config) WelcomeVariableNames() []string {
+	return sortedKeys(c.WelcomeVariables)
+}
+
+// emailData collects the data available to the welcome email from a plan.
+func (h *Handler) emailData(p *Plan) *EmailData {
+	data := &EmailData{
+		Name:          p.Name,
+		FirstName:     p.FirstName,
+		LastName:      p.LastName,
+		Username:      p.Username,
+		Email:         p.Email,
+		GitlabURL:     strings.TrimSuffix(h.GitlabURL, "/") + "/users/sign_in",
+		MattermostURL: strings.TrimSuffix(h.MattermostURL, "/") + "/login",
+		PasswordURL:   strings.TrimSuffix(h.GitlabURL, "/") + "/users/password/new",
+		ChecklistURL:  p.ChecklistURL,
+	}
+	if data.FirstName == "" {
+		// One-word names have no first name, greet people by their name.
+		data.FirstName = p.Name
+	}
+	for _, tg := range p.Teams {
+		data.Teams = append(data.Teams, tg.Team)
+		for _, cg := range tg.Channels {
+			data.Channels = append(data.Channels, cg.Channel)
+		}
+	}
+	for _, r := range p.Rules {
+		data.Rules = append(data.Rules, r.Name)
+	}
+	return data
+}
+
+// emailVariables renders the welcome email template variables.
+func (h *Handler) emailVariables(p *Plan) (map[string]string, error) {
+	data := h.emailData(p)
+	res := map[string]string{}
+	for name, tmpl := range h.Config.welcomeVars {
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, data); err != nil {
+			return nil, fmt.Errorf("rendering email variable %q: %w", name, err)
+		}
+		res[name] = sb.String()
+	}
+	return res, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	var res []string
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -5,167 +5,372 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"github.com/mailgun/mailgun-go/v4"
 	mattermost "github.com/mattermost/mattermost-server/v6/model"
 	"github.com/xanzy/go-gitlab"
+	"gitlab.operationuplift.work/operations/development/janus/lib/mailer"
 )
 
 type Handler struct {
 	Config        *Config
 	UseSSO        bool
 	EmailFromAddr string
+	GitlabURL     string // base URL, used for links in the welcome email.
+	MattermostURL string // base URL, used for links in the welcome email.
 
 	// TODO(quad404): convert to interfaces and add test doubles.
-	Mattermost   *mattermost.Client4
-	Gitlab *gitlab.Client
-	Mailgun      mailgun.Mailgun
+	Mattermost *mattermost.Client4
+	Gitlab     *gitlab.Client
+	Mailer     mailer.Mailer
+
+	Jobs  *Queue    // runs the provisioning pipeline in the background.
+	Names *Resolver // maps Mattermost names to IDs; nil if the config uses IDs.
+
+	locks identityLocks // one operation per user at a time.
+
+	lookupUsername func(username, email string) (bool, error) // replaces usernameTaken in tests.
 }
 
-func (h *Handler) Provision(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	ctx := req.Context()
+// Provision queues an onboarding request and acknowledges it with the ID of
+// the job that will carry it out. For NocoDB envelopes, each row gets its own
+// job, and the response reports on every row. Requests for users with a job
+// in progress are answered with a 409.
+func (h *Handler) Provision(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	rows, envelope, ok := h.readPayloads(w, req, ps)
+	if !ok {
+		return
+	}
 
-	if req.Body == nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+	if !envelope {
+		payload := rows[0].User
+		job, err := h.Jobs.Enqueue(payload)
+		if errors.Is(err, ErrBusy) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("[ERROR] Queueing provisioning of %s: %v", payload.Email, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"id":    job.ID,
+			"state": job.State,
+		})
 		return
 	}
-	body, err := io.ReadAll(req.Body)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+
+	var accepted int
+	results := make([]RowResult, len(rows))
+	for i, row := range rows {
+		res := &results[i]
+		res.Row = i
+		if row.Errors != nil {
+			res.Errors = row.Errors
+			continue
+		}
+		job, err := h.Jobs.Enqueue(row.User)
+		if errors.Is(err, ErrBusy) {
+			res.Error = err.Error()
+			continue
+		}
+		if err != nil {
+			log.Printf("[ERROR] Queueing provisioning of %s: %v", row.User.Email, err)
+			res.Error = "internal error"
+			continue
+		}
+		res.ID, res.State = job.ID, job.State
+		accepted++
+	}
+	writeRowReport(w, http.StatusAccepted, accepted, results)
+}
+
+// Plan answers with what provisioning the posted user would do, without
+// changing anything. For NocoDB envelopes, it answers with a plan per row.
+func (h *Handler) Plan(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	rows, envelope, ok := h.readPayloads(w, req, ps)
+	if !ok {
 		return
 	}
-	defer req.Body.Close()
 
-	payload := &OnboardingUser{}
-	if err := json.Unmarshal(body, payload); err != nil {
-		http.Error(w, "Bad payload", http.StatusBadRequest)
+	if !envelope {
+		p, err := h.plan(rows[0].User)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
 		return
 	}
 
-	uid, err := h.provisionGitlab(payload)
+	var accepted int
+	results := make([]RowResult, len(rows))
+	for i, row := range rows {
+		res := &results[i]
+		res.Row = i
+		if row.Errors != nil {
+			res.Errors = row.Errors
+			continue
+		}
+		p, err := h.plan(row.User)
+		if err != nil {
+			res.Error = err.Error()
+			continue
+		}
+		res.Plan = p
+		accepted++
+	}
+	writeRowReport(w, http.StatusOK, accepted, results)
+}
+
+// Status answers with the job with the given ID: its payload, state, and
+// the steps of every attempt. Jobs that failed because the user clashes with
+// an existing account are answered with a 409, as the webhook itself only
+// queues them.
+func (h *Handler) Status(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	id, err := strconv.ParseUint(ps.ByName("id"), 10, 64)
 	if err != nil {
-		log.Printf("[ERROR] Provisioning Gitlab: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
-
-	if err := h.provisionMattermost(payload, uid); err != nil {
-		log.Printf("[ERROR] Provisioning Mattermost: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	job, err := h.Jobs.Store.Get(id)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
 		return
+	case err != nil:
+		log.Printf("[ERROR] Getting provisioning job %d: %v", id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusOK
+	if res := job.Latest(); job.State == JobDead && res != nil && res.Conflict != nil {
+		status = http.StatusConflict
 	}
+	writeJSON(w, status, job)
+}
 
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-	if err := h.sendWelcomeEmail(ctx, payload, uid); err != nil {
-		log.Printf("[ERROR] Sending welcome email: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// stage is a resumable part of the provisioning pipeline.
+type stage struct {
+	name string
+	run  func(ctx context.Context, p *Plan, cp *Checkpoint, tx *txn) error
+}
+
+func (h *Handler) pipeline() []stage {
+	return []stage{
+		{"gitlab", func(_ context.Context, p *Plan, cp *Checkpoint, tx *txn) error {
+			return h.provisionGitlab(p, cp, tx)
+		}},
+		{"mattermost", func(_ context.Context, p *Plan, cp *Checkpoint, tx *txn) error {
+			return h.provisionMattermost(p, cp, tx)
+		}},
+		{"checklist", func(_ context.Context, p *Plan, cp *Checkpoint, tx *txn) error {
+			if p.Checklist == nil {
+				tx.skip("gitlab: open checklist issue", "no checklist project configured")
+				return nil
+			}
+			// Like the welcome message, the checklist is a nicety: failing to
+			// open it is reported but does not fail the run.
+			url, err := h.openChecklist(p.Checklist, cp.GitlabUserID, tx)
+			if err != nil {
+				log.Printf("[WARNING] Opening checklist issue for %s: %v", p.Username, err)
+				return nil
+			}
+			log.Printf("[INFO] Opened checklist issue %s for %s.", url, p.Username)
+			cp.ChecklistURL = url
+			return h.setChecklistURL(p, url)
+		}},
+		{"email", func(ctx context.Context, p *Plan, cp *Checkpoint, tx *txn) error {
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			return tx.do("email: send welcome email", func() (func() error, error) {
+				return nil, h.sendWelcomeEmail(ctx, p)
+			})
+		}},
+		{"welcome-message", func(_ context.Context, p *Plan, cp *Checkpoint, tx *txn) error {
+			const step = "mattermost: send welcome message"
+			if p.WelcomeMessage == "" {
+				tx.skip(step, "no welcome message configured")
+				return nil
+			}
+			// The accounts are usable without it, so a message that cannot
+			// be delivered is reported but does not fail the run.
+			if err := tx.do(step, func() (func() error, error) {
+				return nil, h.sendWelcomeMessage(p.WelcomeMessage, cp.MattermostUserID)
+			}); err != nil {
+				log.Printf("[WARNING] Sending welcome message to %s: %v", p.Username, err)
+				tx.res.WelcomeDM = err.Error()
+				return nil
+			}
+			tx.res.WelcomeDM = "delivered"
+			return nil
+		}},
 	}
 }
 
-func (h *Handler) provisionGitlab(payload *OnboardingUser) (userID int, _ error) {
-	// Create a new user and force them to reset their password.
-	user, _, err := h.Gitlab.Users.CreateUser(&gitlab.CreateUserOptions{
-		Email:            gitlab.String(payload.Email),
-		ResetPassword:    gitlab.Bool(true),
-		Username:         gitlab.String(payload.TelegramHandle),
-		Name:             gitlab.String(payload.Name),
-		SkipConfirmation: gitlab.Bool(true),
-	})
-	if err != nil {
-		return 0, fmt.Errorf("creating user: %w", err)
-	} else {
-		log.Printf("[INFO] Created gitlab user %d for %s.", user.ID, payload.Email)
+// provision runs the provisioning pipeline for a single user, skipping the
+// stages that cp records as done. Every step is recorded in tx, so the
+// caller can roll back on failure, and checkpoint (if not nil) is called
+// whenever cp changes.
+func (h *Handler) provision(ctx context.Context, payload *OnboardingUser, cp *Checkpoint, tx *txn, checkpoint func()) error {
+	// Accounts created by earlier attempts are undone along with the rest if
+	// this attempt is rolled back, even if it fails before getting to them.
+	if cp.GitlabCreated {
+		uid := cp.GitlabUserID
+		tx.onUndo("gitlab: delete user created by an earlier attempt", func() error {
+			_, err := h.Gitlab.Users.DeleteUser(uid)
+			return err
+		})
+	}
+	if cp.MattermostCreated {
+		userID := cp.MattermostUserID
+		tx.onUndo("mattermost: delete user created by an earlier attempt", func() error {
+			return h.deleteMattermostUser(userID)
+		})
 	}
 
-	// Temporarily impersonate the user to disable their notifications.
-	token, _, err := h.Gitlab.Users.CreateImpersonationToken(user.ID, &gitlab.CreateImpersonationTokenOptions{
-		Name:      gitlab.String("provisioning-token"),
-		Scopes:    strListPtr("api"),
-		ExpiresAt: timePtr(time.Now().Add(24 * time.Hour)),
-	})
+	p, err := h.plan(payload)
 	if err != nil {
-		return 0, fmt.Errorf("creating impersonation token: %w", err)
-	} else {
-		log.Printf("[INFO] Created impersonation token %d for user %d", token.ID, user.ID)
+		return fmt.Errorf("planning: %w", err)
 	}
-	defer func() {
-		if _, err := h.Gitlab.Users.RevokeImpersonationToken(user.ID, token.ID); err != nil {
-			log.Printf("[WARNING] Revoking impersonation token %d for user %d: %v", token.ID, user.ID, err)
-		} else {
-			log.Printf("[INFO] Revoked impersonation token %d for user %d.", token.ID, user.ID)
+	tx.plan = p
+	if cp.ChecklistURL != "" {
+		if err := h.setChecklistURL(p, cp.ChecklistURL); err != nil {
+			return err
+		}
+	}
+
+	for _, st := range h.pipeline() {
+		if cp.done(st.name) {
+			tx.skip(st.name, "completed by an earlier attempt")
+			continue
+		}
+		err := st.run(ctx, p, cp, tx)
+		if err == nil {
+			cp.Done = append(cp.Done, st.name)
 		}
-	}()
+		if checkpoint != nil {
+			checkpoint()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", st.name, err)
+		}
+	}
+	return nil
+}
 
-	baseURL := h.Gitlab.BaseURL().String()
-	subClient, err := gitlab.NewClient(token.Token, gitlab.WithBaseURL(baseURL))
+func (h *Handler) provisionGitlab(p *Plan, cp *Checkpoint, tx *txn) error {
+	// A redelivered webhook finds the account created the first time round,
+	// in which case we only fill in whatever is missing.
+	user, err := h.findGitlabUser(p.Email, p.Username)
 	if err != nil {
-		return 0, fmt.Errorf("creating user-specific subclient: %w", err)
+		return err
 	}
-	if _, _, err := subClient.NotificationSettings.UpdateGlobalSettings(&gitlab.NotificationSettingsOptions{
-		Level: gitlab.NotificationLevel(gitlab.DisabledNotificationLevel),
+	if user != nil {
+		log.Printf("[INFO] Gitlab user %d already exists for %s, reusing it.", user.ID, p.Email)
+		tx.skip("gitlab: create user", fmt.Sprintf("user %d already exists", user.ID))
+	} else if err := tx.do("gitlab: create user", func() (func() error, error) {
+		// Create a new user and force them to reset their password.
+		var err error
+		user, _, err = h.Gitlab.Users.CreateUser(&gitlab.CreateUserOptions{
+			Email:            gitlab.String(p.Email),
+			ResetPassword:    gitlab.Bool(true),
+			Username:         gitlab.String(p.Username),
+			Name:             gitlab.String(p.Name),
+			SkipConfirmation: gitlab.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[INFO] Created gitlab user %d for %s.", user.ID, p.Email)
+		cp.GitlabCreated = true
+		return func() error {
+			_, err := h.Gitlab.Users.DeleteUser(user.ID)
+			return err
+		}, nil
 	}); err != nil {
-		log.Printf("[WARNING] Disabling user %d notifications: %v", user.ID, err)
-	} else {
-		log.Printf("[INFO] Disabled user %d notifications.", user.ID)
-	}
-
-	// Add the user to group and/or project.
-	if h.Config.GitlabGroup != "" {
-		if _, _, err := h.Gitlab.GroupMembers.AddGroupMember(
-			h.Config.GitlabGroup,
-			&gitlab.AddGroupMemberOptions{
-				UserID:      gitlab.Int(user.ID),
-				AccessLevel: gitlab.AccessLevel(gitlab.DeveloperPermissions),
-			},
-		); err != nil {
-			return 0, fmt.Errorf("adding group member %d: %w", user.ID, err)
-		} else {
-			log.Printf("[INFO] Added gitlab user %d to group %q.", user.ID, h.Config.GitlabGroup)
-		}
-	}
-
-	if h.Config.GitlabProject != "" {
-		if _, _, err := h.Gitlab.ProjectMembers.AddProjectMember(
-			h.Config.GitlabProject,
-			&gitlab.AddProjectMemberOptions{
-				UserID:      gitlab.Int(user.ID),
-				AccessLevel: gitlab.AccessLevel(gitlab.DeveloperPermissions),
-			},
-		); err != nil {
-			return 0, fmt.Errorf("adding project member %d: %w", user.ID, err)
-		} else {
-			log.Printf("[INFO] Added gitlab user %d to project %q.", user.ID, h.Config.GitlabProject)
-		}
-	}
-	return user.ID, nil
+		return err
+	}
+	cp.GitlabUserID = user.ID
+
+	if p.Account != nil {
+		h.applyAccountProfile(p.Account, user.ID, cp.GitlabCreated, tx)
+	}
+
+	// Add the user to groups and projects.
+	for _, g := range p.Gitlab {
+		if err := h.grantGitlab(g, user.ID, tx); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (h *Handler) provisionMattermost(payload *OnboardingUser, authID int) error {
-	nameParts := strings.Split(payload.Name, " ")
-	if len(nameParts) == 0 {
-		return errors.New("field name is required")
+// grantGitlab makes the user a member of a Gitlab group or project, unless
+// they already are.
+func (h *Handler) grantGitlab(g GitlabGrant, uid int, tx *txn) error {
+	if g.Group != "" {
+		step := fmt.Sprintf("gitlab: add to group %q as %s", g.Group, g.Access)
+		if ok, err := h.isGroupMember(g.Group, uid); err != nil {
+			return fmt.Errorf("checking group %q membership: %w", g.Group, err)
+		} else if ok {
+			tx.skip(step, "already a member")
+			return nil
+		}
+		return tx.do(step, func() (func() error, error) {
+			if _, _, err := h.Gitlab.GroupMembers.AddGroupMember(g.Group, &gitlab.AddGroupMemberOptions{
+				UserID:      gitlab.Int(uid),
+				AccessLevel: gitlab.AccessLevel(gitlab.AccessLevelValue(g.Access)),
+				ExpiresAt:   stringPtr(g.Expires),
+			}); err != nil {
+				return nil, err
+			}
+			log.Printf("[INFO] Added gitlab user %d to group %q.", uid, g.Group)
+			return func() error {
+				_, err := h.Gitlab.GroupMembers.RemoveGroupMember(g.Group, uid)
+				return err
+			}, nil
+		})
 	}
-	firstName := strings.Join(nameParts[:len(nameParts)-1], " ")
-	lastName := nameParts[len(nameParts)-1]
 
-	log.Printf("Provisioning user %s (%s) in Mattermost...", payload.TelegramHandle, payload.Name)
+	step := fmt.Sprintf("gitlab: add to project %q as %s", g.Project, g.Access)
+	if ok, err := h.isProjectMember(g.Project, uid); err != nil {
+		return fmt.Errorf("checking project %q membership: %w", g.Project, err)
+	} else if ok {
+		tx.skip(step, "already a member")
+		return nil
+	}
+	return tx.do(step, func() (func() error, error) {
+		if _, _, err := h.Gitlab.ProjectMembers.AddProjectMember(g.Project, &gitlab.AddProjectMemberOptions{
+			UserID:      gitlab.Int(uid),
+			AccessLevel: gitlab.AccessLevel(gitlab.AccessLevelValue(g.Access)),
+			ExpiresAt:   stringPtr(g.Expires),
+		}); err != nil {
+			return nil, err
+		}
+		log.Printf("[INFO] Added gitlab user %d to project %q.", uid, g.Project)
+		return func() error {
+			_, err := h.Gitlab.ProjectMembers.DeleteProjectMember(g.Project, uid)
+			return err
+		}, nil
+	})
+}
+
+func (h *Handler) provisionMattermost(p *Plan, cp *Checkpoint, tx *txn) error {
+	log.Printf("Provisioning user %s (%s) in Mattermost...", p.Username, p.Name)
 	user := &mattermost.User{
-		Username:  payload.TelegramHandle,
-		Email:     payload.Email,
-		FirstName: firstName,
-		LastName:  lastName,
+		Username:  p.Username,
+		Email:     p.Email,
+		FirstName: p.FirstName,
+		LastName:  p.LastName,
 	}
 	if h.UseSSO {
-		s := strconv.Itoa(authID)
+		s := strconv.Itoa(cp.GitlabUserID)
 		user.AuthService = mattermost.UserAuthServiceGitlab
 		user.AuthData = &s
 	} else {
@@ -173,65 +378,120 @@ func (h *Handler) provisionMattermost(payload *OnboardingUser, authID int) error
 			"?a1Z" // to pass validation
 	}
 
+	existing, err := h.findMattermostUser(p.Email, p.Username)
+	if err != nil {
+		return err
+	}
 	var userID string
-	if userObj, _, err := h.Mattermost.CreateUser(user); err != nil {
-		return fmt.Errorf("creating user: %w", err)
-	} else {
+	if existing != nil {
+		log.Printf("Mattermost user %s / %s already exists, reusing it.", existing.Username, existing.Id)
+		userID = existing.Id
+		tx.skip("mattermost: create user", fmt.Sprintf("user %s already exists", existing.Id))
+		// Accounts left deactivated, e.g. by a rollback that could not
+		// delete them, are usable again once reactivated.
+		if existing.DeleteAt != 0 {
+			if err := tx.do("mattermost: reactivate user", func() (func() error, error) {
+				if _, err := h.Mattermost.UpdateUserActive(userID, true); err != nil {
+					return nil, err
+				}
+				log.Printf("[INFO] Reactivated mattermost user %s.", userID)
+				return func() error {
+					_, err := h.Mattermost.UpdateUserActive(userID, false)
+					return err
+				}, nil
+			}); err != nil {
+				return err
+			}
+		}
+	} else if err := tx.do("mattermost: create user", func() (func() error, error) {
+		userObj, _, err := h.Mattermost.CreateUser(user)
+		if err != nil {
+			return nil, err
+		}
 		log.Printf("User %s / %s created successfully.", user.Username, userObj.Id)
 		userID = userObj.Id
+		cp.MattermostCreated = true
+		return func() error { return h.deleteMattermostUser(userID) }, nil
+	}); err != nil {
+		return err
 	}
 
-	state := map[string][]string{} // key=team, val=channels
-	for _, rule := range h.Config.Rules {
-		if !has(payload.Skills(), rule.Skill) {
-			continue
-		}
-		// TODO(quad404): Convert from team/chan name to IDs at runtime.
-		if _, ok := state[rule.Team]; !ok {
-			if _, _, err := h.Mattermost.AddTeamMember(rule.Team, userID); err != nil {
-				return fmt.Errorf("adding user to team %q: %w", rule.Team, err)
-			} else {
-				log.Printf("Added user to team %s.", rule.Team)
-				state[rule.Team] = []string{}
+	cp.MattermostUserID = userID
+
+	for _, tg := range p.Teams {
+		tg := tg
+		step := fmt.Sprintf("mattermost: add to team %q", tg.Team)
+		if ok, err := h.isTeamMember(tg.TeamID, userID); err != nil {
+			return fmt.Errorf("checking team %q membership: %w", tg.Team, err)
+		} else if ok {
+			tx.skip(step, "already a member")
+		} else if err := tx.do(step, func() (func() error, error) {
+			if _, _, err := h.Mattermost.AddTeamMember(tg.TeamID, userID); err != nil {
+				return nil, err
 			}
+			log.Printf("Added user to team %s.", tg.Team)
+			return func() error {
+				_, err := h.Mattermost.RemoveTeamMember(tg.TeamID, userID)
+				return err
+			}, nil
+		}); err != nil {
+			return err
 		}
-		for _, channel := range rule.Channels {
-			if has(state[rule.Team], channel) {
-				continue
-			}
-			if _, _, err := h.Mattermost.AddChannelMember(channel, userID); err != nil {
-				return fmt.Errorf("adding user to channel %q: %w", channel, err)
-			} else {
-				log.Printf("Added user to channel %s.", channel)
-				state[rule.Team] = append(state[rule.Team], channel)
+
+		for _, cg := range tg.Channels {
+			cg := cg
+			step := fmt.Sprintf("mattermost: add to channel %q", cg.Channel)
+			if ok, err := h.isChannelMember(cg.ID, userID); err != nil {
+				return fmt.Errorf("checking channel %q membership: %w", cg.Channel, err)
+			} else if ok {
+				tx.skip(step, "already a member")
+			} else if err := tx.do(step, func() (func() error, error) {
+				if _, _, err := h.Mattermost.AddChannelMember(cg.ID, userID); err != nil {
+					return nil, err
+				}
+				log.Printf("Added user to channel %s.", cg.Channel)
+				return func() error {
+					_, err := h.Mattermost.RemoveUserFromChannel(cg.ID, userID)
+					return err
+				}, nil
+			}); err != nil {
+				return err
 			}
 		}
 	}
 	return nil
 }
 
-func (h *Handler) sendWelcomeEmail(ctx context.Context, payload *OnboardingUser, uid int) error {
-	msg := h.Mailgun.NewMessage(h.EmailFromAddr, "Welcome to our server", "", payload.Email)
-	msg.SetTemplate(h.Config.MailgunWelcomeTemplate)
-
-	var errors []string
-	check := func(err error) {
-		if err != nil {
-			errors = append(errors, err.Error())
-		}
+// deleteMattermostUser removes a user created during provisioning. Permanent
+// deletion must be enabled on the server; if it is not, the account is
+// deactivated instead and an error is returned so the operator knows.
+func (h *Handler) deleteMattermostUser(userID string) error {
+	_, perr := h.Mattermost.PermanentDeleteUser(userID)
+	if perr == nil {
+		return nil
 	}
-	check(msg.AddTemplateVariable("first", "todo fill this up"))
-	check(msg.AddTemplateVariable("second", "todo fill this up too"))
-	if len(errors) > 0 {
-		return fmt.Errorf("template variables: %s", strings.Join(errors, ", "))
-	}
-	if resp, id, err := h.Mailgun.Send(ctx, msg); err != nil {
-		return fmt.Errorf("sending email: %w", err)
-	} else {
-		log.Printf("[INFO] Sent welcome email (resp: %s, id: %s).", resp, id)
+	if _, err := h.Mattermost.DeleteUser(userID); err != nil {
+		return fmt.Errorf("permanent delete: %v; deactivate: %w", perr, err)
 	}
+	return fmt.Errorf("permanent delete failed, account deactivated instead: %w", perr)
+}
 
-	return nil
+func (h *Handler) sendWelcomeEmail(ctx context.Context, p *Plan) error {
+	return h.Mailer.Send(ctx, &mailer.Message{
+		From:      h.EmailFromAddr,
+		To:        p.Email,
+		Subject:   "Welcome to our server",
+		Template:  h.Config.WelcomeTemplate,
+		Variables: p.EmailVariables,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[WARNING] Writing JSON response: %v", err)
+	}
 }
 
 func has(list []string, x string) bool {
@@ -244,4 +504,12 @@ func has(list []string, x string) bool {
 }
 
 func strListPtr(a ...string) *[]string { return &a }
-func timePtr(a time.Time) *time.Time   { return &a }
+
+// stringPtr returns nil for the empty string.
+func stringPtr(a string) *string {
+	if a == "" {
+		return nil
+	}
+	return &a
+}
+func timePtr(a time.Time) *time.Time { return &a }
@@ -0,0 +1,248 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IntakeProfile maps the payloads of another intake source, like a form
+// tool, to onboarding users. Each profile has its own webhook route.
+type IntakeProfile struct {
+	Name string
+
+	// Fields maps onboarding fields (name, email, telegram_handle and skills)
+	// to selectors in the payload, like `$.answers[2].text` or
+	// `$.fields["Telegram handle"]`.
+	Fields map[string]string
+
+	// Defaults are used for fields that are not mapped, or that are missing,
+	// null or empty in the payload. Default skills are comma separated.
+	Defaults map[string]string
+
+	// SkillSeparator splits skills given as a string. Defaults to ",".
+	// Skills can also be given as an array.
+	SkillSeparator string
+
+	selectors map[string]selector // set by Validate.
+}
+
+// intakeFields are the onboarding fields a profile can fill in.
+var intakeFields = []string{"name", "email", "telegram_handle", "skills"}
+
+// selector is a parsed field selector: a sequence of object keys (strings)
+// and array indices (ints).
+type selector []interface{}
+
+// parseSelector parses a JSONPath-style selector. Only the root ($), child
+// keys (.key or ["key"]) and array indices ([0]) are supported.
+func parseSelector(s string) (selector, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, errors.New("must start with $")
+	}
+	var res selector
+	rest := s[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("empty key at %q", rest)
+			}
+			res = append(res, key)
+			rest = rest[end+1:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("missing ] in %q", rest)
+			}
+			inner := rest[1:end]
+			if strings.HasPrefix(inner, `"`) {
+				// Quoted keys may contain "]", look for the closing quote.
+				var key string
+				dec := json.NewDecoder(strings.NewReader(rest[1:]))
+				if err := dec.Decode(&key); err != nil {
+					return nil, fmt.Errorf("invalid quoted key in %q: %w", rest, err)
+				}
+				after := rest[1+int(dec.InputOffset()):]
+				if !strings.HasPrefix(after, "]") {
+					return nil, fmt.Errorf("missing ] in %q", rest)
+				}
+				res = append(res, key)
+				rest = after[1:]
+				continue
+			}
+			i, err := strconv.Atoi(inner)
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("invalid index %q", inner)
+			}
+			res = append(res, i)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest)
+		}
+	}
+	return res, nil
+}
+
+// lookup returns the value the selector points to, or nil if there is none.
+func (sel selector) lookup(v interface{}) interface{} {
+	for _, step := range sel {
+		switch step := step.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			v = obj[step]
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok || step >= len(arr) {
+				return nil
+			}
+			v = arr[step]
+		}
+	}
+	return v
+}
+
+// validateIntake checks the intake profiles and parses their selectors.
+func (c *Config) validateIntake() error {
+	names := map[string]bool{}
+	for i := range c.Intake {
+		ip := &c.Intake[i]
+		if ip.Name == "" {
+			return fmt.Errorf("intake #%d: name is required", i+1)
+		}
+		if names[ip.Name] {
+			return fmt.Errorf("intake %q: duplicate name", ip.Name)
+		}
+		names[ip.Name] = true
+
+		ip.selectors = map[string]selector{}
+		for _, field := range sortedKeys(ip.Fields) {
+			if !has(intakeFields, field) {
+				return fmt.Errorf("intake %q: unknown field %q", ip.Name, field)
+			}
+			sel, err := parseSelector(ip.Fields[field])
+			if err != nil {
+				return fmt.Errorf("intake %q: fields.%s: %w", ip.Name, field, err)
+			}
+			ip.selectors[field] = sel
+		}
+		for _, field := range sortedKeys(ip.Defaults) {
+			if !has(intakeFields, field) {
+				return fmt.Errorf("intake %q: unknown default %q", ip.Name, field)
+			}
+		}
+		for _, field := range []string{"name", "email"} {
+			if ip.Fields[field] == "" && ip.Defaults[field] == "" {
+				return fmt.Errorf("intake %q: field %q must be mapped", ip.Name, field)
+			}
+		}
+	}
+	return nil
+}
+
+// intakeProfile returns the profile with the given name, or nil.
+func (c *Config) intakeProfile(name string) *IntakeProfile {
+	for i := range c.Intake {
+		if c.Intake[i].Name == name {
+			return &c.Intake[i]
+		}
+	}
+	return nil
+}
+
+// decode maps a payload to an onboarding user. Values that cannot be
+// mapped are reported as a ValidationError.
+func (ip *IntakeProfile) decode(data []byte) (*OnboardingUser, error) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, decodeError(err)
+	}
+
+	var verr ValidationError
+	values := map[string]string{}
+	for _, field := range intakeFields {
+		v, err := ip.value(field, doc)
+		if err != nil {
+			verr = append(verr, FieldError{field, err.Error()})
+			continue
+		}
+		values[field] = v
+	}
+	if len(verr) > 0 {
+		return nil, verr
+	}
+	return &OnboardingUser{
+		Name:           values["name"],
+		Email:          values["email"],
+		TelegramHandle: values["telegram_handle"],
+		RawSkills:      values["skills"],
+	}, nil
+}
+
+// value extracts one field from the payload, as it would appear in a flat
+// payload. Skills are joined with commas.
+func (ip *IntakeProfile) value(field string, doc interface{}) (string, error) {
+	sel, ok := ip.selectors[field]
+	if !ok {
+		return ip.Defaults[field], nil
+	}
+	switch v := sel.lookup(doc).(type) {
+	case nil:
+		return ip.Defaults[field], nil
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return ip.Defaults[field], nil
+		}
+		if field == "skills" {
+			sep := ip.SkillSeparator
+			if sep == "" {
+				sep = ","
+			}
+			return strings.Join(strings.Split(v, sep), ","), nil
+		}
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case []interface{}:
+		if field != "skills" {
+			return "", fmt.Errorf("%s: must be a string, not an array", ip.Fields[field])
+		}
+		var skills []string
+		for _, s := range v {
+			switch s := s.(type) {
+			case string:
+				skills = append(skills, s)
+			case json.Number:
+				skills = append(skills, s.String())
+			default:
+				return "", fmt.Errorf("%s: must be an array of strings", ip.Fields[field])
+			}
+		}
+		return strings.Join(skills, ","), nil
+	default:
+		return "", fmt.Errorf("%s: must be a string, not %s", ip.Fields[field], describeJSON(v))
+	}
+}
+
+func describeJSON(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return "a boolean"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,99 @@
+package provisioner
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSelector(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want selector
+	}{
+		{"$", nil},
+		{"$.name", selector{"name"}},
+		{"$.answers[2].text", selector{"answers", 2, "text"}},
+		{`$.fields["Telegram handle"]`, selector{"fields", "Telegram handle"}},
+		{`$["a]b"][0]`, selector{"a]b", 0}},
+	} {
+		got, err := parseSelector(tc.in)
+		if err != nil {
+			t.Errorf("parseSelector(%q) failed: %v", tc.in, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("parseSelector(%q) mismatch (-want +got):\n%s", tc.in, diff)
+		}
+	}
+	for _, in := range []string{"", "name", "$.", "$..a", "$[x]", "$[-1]", `$["a"`} {
+		if _, err := parseSelector(in); err == nil {
+			t.Errorf("parseSelector(%q): got no error", in)
+		}
+	}
+}
+
+func TestIntakeDecode(t *testing.T) {
+	c := &Config{Intake: []IntakeProfile{{
+		Name: "forms",
+		Fields: map[string]string{
+			"name":            "$.answers[0].text",
+			"email":           `$.hidden["e-mail"]`,
+			"telegram_handle": "$.answers[1].text",
+			"skills":          "$.answers[2].choices",
+		},
+		Defaults: map[string]string{"telegram_handle": "none", "skills": "General"},
+	}, {
+		Name:           "sheet",
+		Fields:         map[string]string{"name": "$.Name", "email": "$.Email", "skills": "$.Skills"},
+		SkillSeparator: ";",
+	}}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	forms, sheet := c.intakeProfile("forms"), c.intakeProfile("sheet")
+
+	for _, tc := range []struct {
+		profile *IntakeProfile
+		body    string
+		want    *OnboardingUser
+		wantErr ValidationError
+	}{
+		{
+			profile: forms,
+			body:    `{"hidden": {"e-mail": "jane@example.com"}, "answers": [{"text": "Jane Doe"}, {"text": "@jdoe"}, {"choices": ["Go", "Design"]}]}`,
+			want:    &OnboardingUser{Name: "Jane Doe", Email: "jane@example.com", TelegramHandle: "@jdoe", RawSkills: "Go,Design"},
+		},
+		{
+			profile: forms,
+			body:    `{"hidden": {"e-mail": "jane@example.com"}, "answers": [{"text": "Jane Doe"}]}`,
+			want:    &OnboardingUser{Name: "Jane Doe", Email: "jane@example.com", TelegramHandle: "none", RawSkills: "General"},
+		},
+		{
+			profile: sheet,
+			body:    `{"Name": "Jane Doe", "Email": "jane@example.com", "Skills": "Go; Design"}`,
+			want:    &OnboardingUser{Name: "Jane Doe", Email: "jane@example.com", RawSkills: "Go, Design"},
+		},
+		{
+			profile: sheet,
+			body:    `{"Name": ["Jane"], "Email": true, "Skills": [{"x": 1}]}`,
+			wantErr: ValidationError{
+				{"name", "$.Name: must be a string, not an array"},
+				{"email", "$.Email: must be a string, not a boolean"},
+				{"skills", "$.Skills: must be an array of strings"},
+			},
+		},
+	} {
+		got, err := tc.profile.decode([]byte(tc.body))
+		var gotErr ValidationError
+		if err != nil {
+			gotErr = err.(ValidationError)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: decode(%s) mismatch (-want +got):\n%s", tc.profile.Name, tc.body, diff)
+		}
+		if diff := cmp.Diff(tc.wantErr, gotErr); diff != "" {
+			t.Errorf("%s: decode(%s) error mismatch (-want +got):\n%s", tc.profile.Name, tc.body, diff)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package provisioner
+
+import (
+	"strings"
+	"sync"
+)
+
+// identityLocks makes sure that at most one provisioning, update or
+// offboarding operation runs per identity at a time. The zero value is ready
+// to use.
+type identityLocks struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+// tryLock takes the locks for all the given keys, or none of them if any is
+// already held. The returned function releases them.
+func (l *identityLocks) tryLock(keys []string) (unlock func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range keys {
+		if l.held[k] {
+			return nil, false
+		}
+	}
+	if l.held == nil {
+		l.held = map[string]bool{}
+	}
+	for _, k := range keys {
+		l.held[k] = true
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, k := range keys {
+			delete(l.held, k)
+		}
+	}, true
+}
+
+// identityKeys returns the lock keys of a user: their normalized email, and
+// the username they would get before any suffix is added.
+func identityKeys(u *OnboardingUser) []string {
+	email := strings.ToLower(strings.TrimSpace(u.Email))
+	keys := []string{"email:" + email}
+	username := normalizeUsername(u.TelegramHandle)
+	if username == "" {
+		if i := strings.LastIndex(email, "@"); i > 0 {
+			username = normalizeUsername(email[:i])
+		}
+	}
+	if username != "" {
+		keys = append(keys, "username:"+username)
+	}
+	return keys
+}
+
+// lockIdentity takes the locks of the user's identity, if no other operation
+// holds them.
+func (h *Handler) lockIdentity(u *OnboardingUser) (unlock func(), ok bool) {
+	return h.locks.tryLock(identityKeys(u))
+}
@@ -0,0 +1,61 @@
+package provisioner
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestIdentityKeys(t *testing.T) {
+	for _, tc := range []struct {
+		user *OnboardingUser
+		want []string
+	}{
+		{&OnboardingUser{Email: " Jane@Example.com", TelegramHandle: "@JDoe"}, []string{"email:jane@example.com", "username:jdoe"}},
+		{&OnboardingUser{Email: "Jane.Doe@example.com"}, []string{"email:jane.doe@example.com", "username:jane.doe"}},
+	} {
+		if diff := cmp.Diff(tc.want, identityKeys(tc.user)); diff != "" {
+			t.Errorf("identityKeys(%+v) mismatch (-want +got):\n%s", tc.user, diff)
+		}
+	}
+}
+
+func TestIdentityLocks(t *testing.T) {
+	var l identityLocks
+	unlock, ok := l.tryLock([]string{"email:a", "username:a"})
+	if !ok {
+		t.Fatal("first tryLock failed")
+	}
+	if _, ok := l.tryLock([]string{"email:b", "username:a"}); ok {
+		t.Error("tryLock of a held username succeeded")
+	}
+	unlockB, ok := l.tryLock([]string{"email:b", "username:b"})
+	if !ok {
+		t.Error("tryLock of other keys failed")
+	} else {
+		unlockB()
+	}
+	unlock()
+	if _, ok := l.tryLock([]string{"email:a"}); !ok {
+		t.Error("tryLock after unlock failed")
+	}
+}
+
+func TestOffboardBusy(t *testing.T) {
+	h := &Handler{Config: &Config{}}
+	if _, ok := h.lockIdentity(&OnboardingUser{Email: "jane@example.com"}); !ok {
+		t.Fatal("lockIdentity failed")
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/user/offboard/", strings.NewReader(`{"email": "Jane@example.com"}`))
+	h.Offboard(w, req, nil)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Offboard of a busy user: status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if !strings.Contains(w.Body.String(), "in progress") {
+		t.Errorf("Offboard of a busy user: body %s does not explain the conflict", w.Body)
+	}
+}
@@ -0,0 +1,162 @@
+package provisioner
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	mattermost "github.com/mattermost/mattermost-server/v6/model"
+	"github.com/xanzy/go-gitlab"
+)
+
+// ConflictError is returned when an onboarding payload clashes with an
+// existing account that does not belong to the same person.
+type ConflictError struct {
+	System  string `json:"system"`
+	Details string `json:"details"`
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s conflict: %s", e.System, e.Details)
+}
+
+// findGitlabUser looks for an existing Gitlab account with the given email
+// or username. It returns nil if there is none, and a *ConflictError if
+// the email and username point to different accounts.
+func (h *Handler) findGitlabUser(email, username string) (*gitlab.User, error) {
+	byEmail, err := h.findGitlabUserByEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("searching users by email: %w", err)
+	}
+
+	var byUsername *gitlab.User
+	users, _, err := h.Gitlab.Users.ListUsers(&gitlab.ListUsersOptions{Username: gitlab.String(username)})
+	if err != nil {
+		return nil, fmt.Errorf("searching users by username: %w", err)
+	}
+	if len(users) > 0 {
+		byUsername = users[0]
+	}
+
+	switch {
+	case byEmail == nil && byUsername == nil:
+		return nil, nil
+	case byEmail != nil && byUsername != nil && byEmail.ID == byUsername.ID:
+		return byEmail, nil
+	case byEmail != nil:
+		return nil, &ConflictError{
+			System:  "gitlab",
+			Details: fmt.Sprintf("email %s already belongs to user %q, not %q", email, byEmail.Username, username),
+		}
+	default:
+		return nil, &ConflictError{
+			System:  "gitlab",
+			Details: fmt.Sprintf("username %q is already taken by a user with a different email", username),
+		}
+	}
+}
+
+// findGitlabUserByEmail returns the Gitlab user with the given email, or
+// nil if there is none.
+func (h *Handler) findGitlabUserByEmail(email string) (*gitlab.User, error) {
+	users, _, err := h.Gitlab.Users.ListUsers(&gitlab.ListUsersOptions{Search: gitlab.String(email)})
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
+
+// findMattermostUser is the Mattermost counterpart of findGitlabUser.
+func (h *Handler) findMattermostUser(email, username string) (*mattermost.User, error) {
+	byEmail, resp, err := h.Mattermost.GetUserByEmail(email, "")
+	if err != nil && !isNotFound(resp) {
+		return nil, fmt.Errorf("getting user by email: %w", err)
+	}
+	byUsername, resp, err := h.Mattermost.GetUserByUsername(username, "")
+	if err != nil && !isNotFound(resp) {
+		return nil, fmt.Errorf("getting user by username: %w", err)
+	}
+
+	switch {
+	case byEmail == nil && byUsername == nil:
+		return nil, nil
+	case byEmail != nil && byUsername != nil && byEmail.Id == byUsername.Id:
+		return byEmail, nil
+	case byEmail != nil:
+		return nil, &ConflictError{
+			System:  "mattermost",
+			Details: fmt.Sprintf("email %s already belongs to user %q, not %q", email, byEmail.Username, username),
+		}
+	default:
+		return nil, &ConflictError{
+			System:  "mattermost",
+			Details: fmt.Sprintf("username %q is already taken by a user with a different email", username),
+		}
+	}
+}
+
+// isGroupMember reports whether the user is already a direct member of the
+// Gitlab group.
+func (h *Handler) isGroupMember(group string, uid int) (bool, error) {
+	_, resp, err := h.Gitlab.GroupMembers.GetGroupMember(group, uid)
+	return gitlabExists(resp, err)
+}
+
+// isProjectMember reports whether the user is already a direct member of the
+// Gitlab project.
+func (h *Handler) isProjectMember(project string, uid int) (bool, error) {
+	_, resp, err := h.Gitlab.ProjectMembers.GetProjectMember(project, uid)
+	return gitlabExists(resp, err)
+}
+
+// isGitlabMember reports whether the user is a direct member of the group
+// or project.
+func (h *Handler) isGitlabMember(g GitlabGrant, uid int) (bool, error) {
+	if g.Group != "" {
+		return h.isGroupMember(g.Group, uid)
+	}
+	return h.isProjectMember(g.Project, uid)
+}
+
+// isTeamMember reports whether the user is an active member of the team.
+func (h *Handler) isTeamMember(team, userID string) (bool, error) {
+	member, resp, err := h.Mattermost.GetTeamMember(team, userID, "")
+	if err != nil {
+		if isNotFound(resp) {
+			return false, nil
+		}
+		return false, err
+	}
+	return member.DeleteAt == 0, nil
+}
+
+// isChannelMember reports whether the user is a member of the channel.
+func (h *Handler) isChannelMember(channel, userID string) (bool, error) {
+	_, resp, err := h.Mattermost.GetChannelMember(channel, userID, "")
+	if err != nil {
+		if isNotFound(resp) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func isNotFound(resp *mattermost.Response) bool {
+	return resp != nil && resp.StatusCode == http.StatusNotFound
+}
+
+func gitlabExists(resp *gitlab.Response, err error) (bool, error) {
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
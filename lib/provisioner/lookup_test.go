@@ -0,0 +1,139 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	mattermost "github.com/mattermost/mattermost-server/v6/model"
+	"github.com/xanzy/go-gitlab"
+)
+
+// fakeGitlabUsers serves Gitlab's user search from a fixed list of users.
+func fakeGitlabUsers(t *testing.T, users []*gitlab.User) *gitlab.Client {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/users", func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		res := []*gitlab.User{}
+		for _, u := range users {
+			switch {
+			case q.Get("username") != "":
+				if strings.EqualFold(u.Username, q.Get("username")) {
+					res = append(res, u)
+				}
+			case q.Get("search") != "":
+				// Like Gitlab, the search also matches partially.
+				if strings.Contains(strings.ToLower(u.Email), strings.ToLower(q.Get("search"))) {
+					res = append(res, u)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	client, err := gitlab.NewClient("token", gitlab.WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("creating gitlab client: %v", err)
+	}
+	return client
+}
+
+// fakeMattermostUsers serves Mattermost's user lookups from a fixed list of
+// users.
+func fakeMattermostUsers(t *testing.T, users []*mattermost.User) *mattermost.Client4 {
+	find := func(w http.ResponseWriter, match func(u *mattermost.User) bool) {
+		for _, u := range users {
+			if match(u) {
+				json.NewEncoder(w).Encode(u)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "app.user.missing_account.const", "status_code": http.StatusNotFound})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/users/email/", func(w http.ResponseWriter, req *http.Request) {
+		email := strings.TrimPrefix(req.URL.Path, "/api/v4/users/email/")
+		find(w, func(u *mattermost.User) bool { return strings.EqualFold(u.Email, email) })
+	})
+	mux.HandleFunc("/api/v4/users/username/", func(w http.ResponseWriter, req *http.Request) {
+		username := strings.TrimPrefix(req.URL.Path, "/api/v4/users/username/")
+		find(w, func(u *mattermost.User) bool { return u.Username == username })
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return mattermost.NewAPIv4Client(srv.URL)
+}
+
+func TestFindGitlabUser(t *testing.T) {
+	h := &Handler{Gitlab: fakeGitlabUsers(t, []*gitlab.User{
+		{ID: 1, Username: "jane", Email: "jane@example.com"},
+		{ID: 2, Username: "joe", Email: "joe@example.com"},
+		{ID: 3, Username: "jo", Email: "jo@example.org"},
+	})}
+	for _, tc := range []struct {
+		desc, email, username string
+		wantID                int // 0 for none.
+		wantConflict          bool
+	}{
+		{desc: "none", email: "new@example.com", username: "new"},
+		{desc: "same account", email: "jane@example.com", username: "jane", wantID: 1},
+		{desc: "email case", email: "Jane@Example.com", username: "jane", wantID: 1},
+		{desc: "partial email match", email: "jo@example.com", username: "new"},
+		{desc: "email taken", email: "jane@example.com", username: "new", wantConflict: true},
+		{desc: "username taken", email: "new@example.com", username: "joe", wantConflict: true},
+		{desc: "different accounts", email: "jane@example.com", username: "joe", wantConflict: true},
+	} {
+		u, err := h.findGitlabUser(tc.email, tc.username)
+		var cerr *ConflictError
+		switch {
+		case tc.wantConflict:
+			if !errors.As(err, &cerr) || cerr.System != "gitlab" {
+				t.Errorf("%s: findGitlabUser() error = %v, want a gitlab conflict", tc.desc, err)
+			}
+		case err != nil:
+			t.Errorf("%s: findGitlabUser() failed: %v", tc.desc, err)
+		case tc.wantID == 0 && u != nil:
+			t.Errorf("%s: findGitlabUser() = user %d, want none", tc.desc, u.ID)
+		case tc.wantID != 0 && (u == nil || u.ID != tc.wantID):
+			t.Errorf("%s: findGitlabUser() = %+v, want user %d", tc.desc, u, tc.wantID)
+		}
+	}
+}
+
+func TestFindMattermostUser(t *testing.T) {
+	h := &Handler{Mattermost: fakeMattermostUsers(t, []*mattermost.User{
+		{Id: "u1", Username: "jane", Email: "jane@example.com"},
+		{Id: "u2", Username: "joe", Email: "joe@example.com"},
+	})}
+	for _, tc := range []struct {
+		desc, email, username string
+		wantID                string // empty for none.
+		wantConflict          bool
+	}{
+		{desc: "none", email: "new@example.com", username: "new"},
+		{desc: "same account", email: "jane@example.com", username: "jane", wantID: "u1"},
+		{desc: "email taken", email: "jane@example.com", username: "new", wantConflict: true},
+		{desc: "username taken", email: "new@example.com", username: "joe", wantConflict: true},
+		{desc: "different accounts", email: "jane@example.com", username: "joe", wantConflict: true},
+	} {
+		u, err := h.findMattermostUser(tc.email, tc.username)
+		var cerr *ConflictError
+		switch {
+		case tc.wantConflict:
+			if !errors.As(err, &cerr) || cerr.System != "mattermost" {
+				t.Errorf("%s: findMattermostUser() error = %v, want a mattermost conflict", tc.desc, err)
+			}
+		case err != nil:
+			t.Errorf("%s: findMattermostUser() failed: %v", tc.desc, err)
+		case tc.wantID == "" && u != nil:
+			t.Errorf("%s: findMattermostUser() = user %s, want none", tc.desc, u.Id)
+		case tc.wantID != "" && (u == nil || u.Id != tc.wantID):
+			t.Errorf("%s: findMattermostUser() = %+v, want user %s", tc.desc, u, tc.wantID)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package provisioner
+
+// managedGitlab returns every Gitlab group and project Janus grants access
+// to: the global group and project, and those of all rules.
+func (c *Config) managedGitlab() []GitlabGrant {
+	var res []GitlabGrant
+	add := func(g GitlabGrant) {
+		for _, old := range res {
+			if old.Group == g.Group && old.Project == g.Project {
+				return
+			}
+		}
+		res = append(res, GitlabGrant{Group: g.Group, Project: g.Project})
+	}
+	if c.GitlabGroup != "" {
+		add(GitlabGrant{Group: c.GitlabGroup})
+	}
+	if c.GitlabProject != "" {
+		add(GitlabGrant{Project: c.GitlabProject})
+	}
+	for _, r := range c.Rules {
+		for _, g := range r.Gitlab {
+			add(g)
+		}
+	}
+	return res
+}
@@ -1,8 +1,14 @@
 package provisioner
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
+
+	"github.com/xanzy/go-gitlab"
 )
 
 // Config stores configuration for the user provisioner.
@@ -12,15 +18,212 @@ type Config struct {
 
 	Rules []Rule
 
+	// AllowUnknownSkills accepts payloads with skills that no rule mentions.
+	// By default they are rejected, as they are usually typos.
+	AllowUnknownSkills bool
+
+	Usernames UsernamePolicy
+
+	// Intake profiles accept payloads from other sources than NocoDB, on
+	// /user/intake/<name>.
+	Intake []IntakeProfile
+
+	// WelcomeTemplate names the welcome email template: a Mailgun template
+	// or, with the SMTP backend, a template in the email templates
+	// directory. MailgunWelcomeTemplate is its deprecated former name.
+	WelcomeTemplate        string
 	MailgunWelcomeTemplate string
+
+	// WelcomeVariables maps welcome email template variables to Go
+	// templates rendering them from an EmailData, e.g. "{{.FirstName}}".
+	WelcomeVariables map[string]string
+
+	// WelcomeMessage is a Go template rendering, from a WelcomeData, the
+	// direct message the bot sends new users. Rules can override it. If
+	// neither is set, no message is sent.
+	WelcomeMessage string
+
+	// Account configures the Gitlab accounts provisioning creates. Rules can
+	// override its settings.
+	Account AccountProfile
+
+	// KeepOnFailure leaves accounts and memberships created by a failed
+	// provisioning run in place (e.g. to retry later) instead of rolling
+	// them back.
+	KeepOnFailure bool
+
+	Queue QueueConfig
+
+	Offboarding OffboardConfig
+	Updates     UpdateConfig
+	Reconcile   ReconcileConfig
+	Announce    AnnounceConfig
+	Approval    ApprovalConfig
+	Checklist   ChecklistConfig
+
+	// NameRefresh is how often Mattermost team and channel names used in
+	// rules are resolved to IDs again. Defaults to 10 minutes.
+	NameRefresh Duration
+
+	welcomeVars map[string]*template.Template // set by Validate.
+	welcomeMsg  *template.Template            // set by Validate.
+}
+
+// QueueConfig configures background processing of provisioning jobs.
+type QueueConfig struct {
+	File        string   // bbolt database holding the jobs.
+	Workers     int      // number of jobs processed concurrently.
+	MaxAttempts int      // jobs are dead-lettered after this many attempts.
+	Backoff     Duration // delay before the first retry, doubled for each further one.
+	MaxBackoff  Duration // upper bound for the delay between retries.
+}
+
+// Duration is a time.Duration that can be decoded from strings like "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
 }
 
 // Rule encodes an account setup operation based on user's skills.
+//
+// A rule matches when all of its conditions hold: the user has the skill
+// (or any of AnySkills), all of AllSkills, none of NotSkills, and an email
+// address in one of EmailDomains. Empty conditions are ignored.
 type Rule struct {
-	Name     string   // description, for human consumption.
-	Skill    string   // user's skill, used for matching the rule.
-	Team     string   // add the user to this team.
-	Channels []string // add the user to these channels.
+	Name  string // description, for human consumption.
+	Skill string // user's skill, used for matching the rule.
+
+	AnySkills    []string // user has at least one of these skills.
+	AllSkills    []string // user has every one of these skills.
+	NotSkills    []string // user has none of these skills.
+	IgnoreCase   bool     // compare skills case-insensitively.
+	Regex        bool     // skills above are regular expressions matching a whole skill.
+	EmailDomains []string // user's email is in one of these domains.
+
+	Priority int  // rules are evaluated from highest to lowest priority.
+	Stop     bool // do not evaluate lower priority rules if this one matches.
+
+	Team     string        // add the user to this team (name or ID).
+	Channels []string      // add the user to these channels of the team (names or IDs).
+	Gitlab   []GitlabGrant // add the user to these Gitlab groups and projects.
+	Sticky   bool          // updates never remove the memberships above.
+	AutoFix  bool          // reconciliation restores the team and channels above.
+
+	RequireApproval bool // users matching the rule are held for approval.
+
+	Meet  []string // people new users should meet, listed in their checklist issue.
+	Tasks []string // further checklist items, in Markdown.
+
+	// WelcomeMessage overrides the global welcome message template for users
+	// matching the rule. Of several matching rules, the one with the highest
+	// priority wins.
+	WelcomeMessage string
+
+	// Account overrides settings of the global account profile for users
+	// matching the rule. Of several matching rules, the one with the highest
+	// priority wins, setting by setting.
+	Account *AccountProfile
+
+	matcher    *ruleMatcher       // set by Config.Validate.
+	welcomeMsg *template.Template // set by Config.Validate.
+}
+
+// GitlabGrant is a Gitlab group or project membership.
+type GitlabGrant struct {
+	Group   string      `json:"group,omitempty"`   // group path or ID.
+	Project string      `json:"project,omitempty"` // project path or ID.
+	Access  AccessLevel `json:"access"`            // defaults to developer.
+	Expires string      `json:"expires,omitempty"` // YYYY-MM-DD, or a number of days like "90d".
+}
+
+// expiryDate returns the membership expiry as a YYYY-MM-DD date, counting
+// relative expiries from today.
+func (g GitlabGrant) expiryDate(today time.Time) string {
+	return expiryDate(g.Expires, today)
+}
+
+func (g GitlabGrant) validate() error {
+	if (g.Group == "") == (g.Project == "") {
+		return errors.New("exactly one of group and project is required")
+	}
+	if err := validateExpiry(g.Expires); err != nil {
+		return fmt.Errorf("expires: %w", err)
+	}
+	return nil
+}
+
+const dateFormat = "2006-01-02"
+
+// expiryDate resolves an expiry to a YYYY-MM-DD date, counting relative
+// expiries from today. An empty expiry stays empty.
+func expiryDate(expires string, today time.Time) string {
+	if days, ok := relativeDays(expires); ok {
+		return today.AddDate(0, 0, days).Format(dateFormat)
+	}
+	return expires
+}
+
+// validateExpiry checks that an expiry is empty, a date or a number of days.
+func validateExpiry(expires string) error {
+	if expires == "" {
+		return nil
+	}
+	if _, ok := relativeDays(expires); ok {
+		return nil
+	}
+	if _, err := time.Parse(dateFormat, expires); err != nil {
+		return fmt.Errorf("want YYYY-MM-DD or a number of days like \"90d\", got %q", expires)
+	}
+	return nil
+}
+
+func relativeDays(s string) (int, bool) {
+	if !strings.HasSuffix(s, "d") {
+		return 0, false
+	}
+	days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+	if err != nil || days <= 0 {
+		return 0, false
+	}
+	return days, true
+}
+
+// AccessLevel is a Gitlab access level, given by name in the config.
+type AccessLevel gitlab.AccessLevelValue
+
+var accessLevels = map[string]gitlab.AccessLevelValue{
+	"guest":      gitlab.GuestPermissions,
+	"reporter":   gitlab.ReporterPermissions,
+	"developer":  gitlab.DeveloperPermissions,
+	"maintainer": gitlab.MaintainerPermissions,
+	"owner":      gitlab.OwnerPermissions,
+}
+
+func (a *AccessLevel) UnmarshalText(text []byte) error {
+	v, ok := accessLevels[strings.ToLower(string(text))]
+	if !ok {
+		return fmt.Errorf("unknown access level %q (want one of guest, reporter, developer, maintainer, owner)", text)
+	}
+	*a = AccessLevel(v)
+	return nil
+}
+
+func (a AccessLevel) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a AccessLevel) String() string {
+	for name, v := range accessLevels {
+		if AccessLevel(v) == a {
+			return name
+		}
+	}
+	return strconv.Itoa(int(a))
 }
 
 type NocoObject struct {
@@ -39,5 +242,11 @@ type OnboardingUser struct {
 }
 
 func (u *OnboardingUser) Skills() []string {
-	return strings.Split(u.RawSkills, ",")
+	var res []string
+	for _, s := range strings.Split(u.RawSkills, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+	return res
 }
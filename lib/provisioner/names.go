@@ -0,0 +1,165 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mattermost "github.com/mattermost/mattermost-server/v6/model"
+)
+
+// Resolver maps the Mattermost team and channel names used in the config
+// to IDs. Raw IDs are accepted as well. Lookups are served from a cache,
+// which is filled by Refresh.
+type Resolver struct {
+	Mattermost *mattermost.Client4
+	Config     *Config
+
+	mu       sync.RWMutex
+	teams    map[string]string    // team name to ID
+	channels map[[2]string]string // team ID and channel name to ID
+	urlNames map[string]string    // team and channel IDs to the names used in URLs
+}
+
+// Refresh looks up every team and channel named in the config. If any of
+// them cannot be found, it returns an error and the cache is left as is.
+func (r *Resolver) Refresh() error {
+	teams := map[string]string{}
+	channels := map[[2]string]string{}
+	urlNames := map[string]string{}
+	resolve := func(team string, names []string) error {
+		teamID, ok := teams[team]
+		if !ok {
+			t, err := r.lookupTeam(team)
+			if err != nil {
+				return fmt.Errorf("team %q: %w", team, err)
+			}
+			teamID = t.Id
+			teams[team] = teamID
+			urlNames[teamID] = t.Name
+		}
+		for _, channel := range names {
+			key := [2]string{teamID, channel}
+			if _, ok := channels[key]; ok {
+				continue
+			}
+			c, err := r.lookupChannel(teamID, channel)
+			if err != nil {
+				return fmt.Errorf("channel %q: %w", channel, err)
+			}
+			channels[key] = c.Id
+			urlNames[c.Id] = c.Name
+		}
+		return nil
+	}
+	for i, rule := range r.Config.Rules {
+		if rule.Team == "" {
+			continue
+		}
+		if err := resolve(rule.Team, rule.Channels); err != nil {
+			return fmt.Errorf("rule #%d (%q): %w", i+1, rule.Name, err)
+		}
+	}
+	if ac := r.Config.Announce; ac.Channel != "" {
+		if err := resolve(ac.Team, []string{ac.Channel}); err != nil {
+			return fmt.Errorf("announce: %w", err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.teams, r.channels, r.urlNames = teams, channels, urlNames
+	return nil
+}
+
+// Run refreshes the cache periodically until ctx is done. Failed refreshes
+// are logged and the previous names stay in use.
+func (r *Resolver) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Refresh(); err != nil {
+				log.Printf("[WARNING] Refreshing Mattermost names: %v", err)
+			}
+		}
+	}
+}
+
+// Team returns the ID of the named team.
+func (r *Resolver) Team(name string) (string, error) {
+	if r == nil {
+		return name, nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.teams[name]
+	if !ok {
+		return "", fmt.Errorf("unknown team %q", name)
+	}
+	return id, nil
+}
+
+// Channel returns the ID of the named channel in the given team.
+func (r *Resolver) Channel(teamID, name string) (string, error) {
+	if r == nil {
+		return name, nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.channels[[2]string{teamID, name}]
+	if !ok {
+		return "", fmt.Errorf("unknown channel %q", name)
+	}
+	return id, nil
+}
+
+// URLName returns the name used in Mattermost URLs for the team or channel
+// with the given ID. Unknown IDs are returned as is.
+func (r *Resolver) URLName(id string) string {
+	if r == nil {
+		return id
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if name, ok := r.urlNames[id]; ok {
+		return name
+	}
+	return id
+}
+
+func (r *Resolver) lookupTeam(name string) (*mattermost.Team, error) {
+	team, resp, err := r.Mattermost.GetTeamByName(name, "")
+	if err == nil {
+		return team, nil
+	}
+	if !isNotFound(resp) || !mattermost.IsValidId(name) {
+		return nil, err
+	}
+	if team, _, err = r.Mattermost.GetTeam(name, ""); err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+func (r *Resolver) lookupChannel(teamID, name string) (*mattermost.Channel, error) {
+	channel, resp, err := r.Mattermost.GetChannelByName(name, teamID, "")
+	if err == nil {
+		return channel, nil
+	}
+	if !isNotFound(resp) || !mattermost.IsValidId(name) {
+		return nil, err
+	}
+	if channel, _, err = r.Mattermost.GetChannel(name, ""); err != nil {
+		return nil, err
+	}
+	if channel.TeamId != teamID {
+		return nil, fmt.Errorf("channel %s belongs to another team", name)
+	}
+	return channel, nil
+}
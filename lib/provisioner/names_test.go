@@ -0,0 +1,132 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	mattermost "github.com/mattermost/mattermost-server/v6/model"
+)
+
+// fakeMattermostNames serves Mattermost's team and channel lookups. While
+// *down is set, every request fails.
+func fakeMattermostNames(t *testing.T, teams []*mattermost.Team, channels []*mattermost.Channel, down *bool) *mattermost.Client4 {
+	reply := func(w http.ResponseWriter, v interface{}) {
+		if v == nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "store.sql.not_found", "status_code": http.StatusNotFound})
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if *down {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "down", "status_code": http.StatusInternalServerError})
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v4/"), "/")
+		switch {
+		case len(parts) == 3 && parts[0] == "teams" && parts[1] == "name":
+			for _, team := range teams {
+				if team.Name == parts[2] {
+					reply(w, team)
+					return
+				}
+			}
+		case len(parts) == 2 && parts[0] == "teams":
+			for _, team := range teams {
+				if team.Id == parts[1] {
+					reply(w, team)
+					return
+				}
+			}
+		case len(parts) == 5 && parts[0] == "teams" && parts[2] == "channels" && parts[3] == "name":
+			for _, c := range channels {
+				if c.TeamId == parts[1] && c.Name == parts[4] {
+					reply(w, c)
+					return
+				}
+			}
+		case len(parts) == 2 && parts[0] == "channels":
+			for _, c := range channels {
+				if c.Id == parts[1] {
+					reply(w, c)
+					return
+				}
+			}
+		}
+		reply(w, nil)
+	}))
+	t.Cleanup(srv.Close)
+	return mattermost.NewAPIv4Client(srv.URL)
+}
+
+func TestResolver(t *testing.T) {
+	ops := &mattermost.Team{Id: mattermost.NewId(), Name: "operations"}
+	other := &mattermost.Team{Id: mattermost.NewId(), Name: "other"}
+	dev := &mattermost.Channel{Id: mattermost.NewId(), TeamId: ops.Id, Name: "dev"}
+	data := &mattermost.Channel{Id: mattermost.NewId(), TeamId: ops.Id, Name: "data"}
+	foreign := &mattermost.Channel{Id: mattermost.NewId(), TeamId: other.Id, Name: "foreign"}
+	down := false
+	client := fakeMattermostNames(t, []*mattermost.Team{ops, other}, []*mattermost.Channel{dev, data, foreign}, &down)
+
+	r := &Resolver{
+		Mattermost: client,
+		Config: &Config{Rules: []Rule{
+			{Name: "by name", Team: "operations", Channels: []string{"dev"}},
+			{Name: "by ID", Team: ops.Id, Channels: []string{data.Id}},
+		}},
+	}
+	if err := r.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	for _, tc := range []struct {
+		team, channel string
+		wantID        string
+		wantURLName   string
+	}{
+		{team: "operations", wantID: ops.Id, wantURLName: "operations"},
+		{team: ops.Id, wantID: ops.Id, wantURLName: "operations"},
+		{team: "operations", channel: "dev", wantID: dev.Id, wantURLName: "dev"},
+		{team: ops.Id, channel: data.Id, wantID: data.Id, wantURLName: "data"},
+	} {
+		teamID, err := r.Team(tc.team)
+		id := teamID
+		if err == nil && tc.channel != "" {
+			id, err = r.Channel(teamID, tc.channel)
+		}
+		if err != nil || id != tc.wantID {
+			t.Errorf("resolving %q/%q = %q, %v; want %q", tc.team, tc.channel, id, err, tc.wantID)
+			continue
+		}
+		if got := r.URLName(id); got != tc.wantURLName {
+			t.Errorf("URLName(%q) = %q, want %q", id, got, tc.wantURLName)
+		}
+	}
+	if _, err := r.Team("other"); err == nil {
+		t.Error("Team(other) succeeded for a team no rule uses, want error")
+	}
+
+	// Failed refreshes keep the names resolved before.
+	for _, tc := range []struct {
+		desc  string
+		rules []Rule
+		down  bool
+	}{
+		{desc: "server down", rules: r.Config.Rules, down: true},
+		{desc: "unknown team", rules: []Rule{{Name: "typo", Team: "operation"}}},
+		{desc: "channel of another team", rules: []Rule{{Name: "foreign", Team: "operations", Channels: []string{foreign.Id}}}},
+	} {
+		down = tc.down
+		r.Config = &Config{Rules: tc.rules}
+		if err := r.Refresh(); err == nil {
+			t.Errorf("%s: Refresh succeeded, want error", tc.desc)
+		}
+		if id, err := r.Channel(ops.Id, "dev"); err != nil || id != dev.Id {
+			t.Errorf("%s: Channel(dev) after failed refresh = %q, %v; want %q", tc.desc, id, err, dev.Id)
+		}
+	}
+}
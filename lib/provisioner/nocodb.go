@@ -0,0 +1,157 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// nocoEnvelope is the webhook body sent by newer NocoDB versions. Bulk
+// inserts carry several rows.
+type nocoEnvelope struct {
+	Type string `json:"type"`
+	Data struct {
+		TableName string            `json:"table_name"`
+		Rows      []json.RawMessage `json:"rows"`
+	} `json:"data"`
+}
+
+// nocoInsertEvents are the envelope types that onboard users.
+var nocoInsertEvents = []string{"records.after.insert", "records.after.bulkInsert"}
+
+// payloadRow is one onboarding user from a request, or what is wrong with
+// it.
+type payloadRow struct {
+	User   *OnboardingUser
+	Errors ValidationError
+}
+
+// RowResult reports what happened to one row of a NocoDB envelope.
+type RowResult struct {
+	Row    int          `json:"row"`              // index in data.rows.
+	ID     uint64       `json:"id,omitempty"`     // job ID, for queued rows.
+	State  JobState     `json:"state,omitempty"`  // job state, for queued rows.
+	Plan   *Plan        `json:"plan,omitempty"`   // for dry runs.
+	Errors []FieldError `json:"errors,omitempty"` // validation errors.
+	Error  string       `json:"error,omitempty"`  // any other error.
+}
+
+// isEnvelope tells a NocoDB envelope from a legacy flat payload, which
+// has neither a type nor a data key at the top level.
+func isEnvelope(body []byte) bool {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return false
+	}
+	_, hasType := keys["type"]
+	_, hasData := keys["data"]
+	return hasType && hasData
+}
+
+// decodeUser decodes and validates a single flat onboarding payload.
+func (h *Handler) decodeUser(data []byte) (*OnboardingUser, error) {
+	u := &OnboardingUser{}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, decodeError(err)
+	}
+	if err := h.Config.CheckPayload(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// readPayloads decodes the onboarding users from the request body. On the
+// intake routes, the body is mapped with the profile named in the route.
+// Otherwise it is either a flat payload or a NocoDB envelope; rows of an
+// envelope are validated independently, and invalid ones are returned with
+// their errors. On a request-level error, including an invalid flat
+// payload, it responds to the request and returns false.
+func (h *Handler) readPayloads(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (rows []payloadRow, envelope bool, ok bool) {
+	var profile *IntakeProfile
+	if name := ps.ByName("profile"); name != "" {
+		if profile = h.Config.intakeProfile(name); profile == nil {
+			http.Error(w, "Unknown intake profile", http.StatusNotFound)
+			return nil, false, false
+		}
+	}
+
+	if req.Body == nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return nil, false, false
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return nil, false, false
+	}
+	defer req.Body.Close()
+
+	if profile != nil {
+		u, err := profile.decode(body)
+		if err == nil {
+			err = h.Config.CheckPayload(u)
+		}
+		if err != nil {
+			rejectPayload(w, err)
+			return nil, false, false
+		}
+		return []payloadRow{{User: u}}, false, true
+	}
+	if !isEnvelope(body) {
+		u, err := h.decodeUser(body)
+		if err != nil {
+			rejectPayload(w, err)
+			return nil, false, false
+		}
+		return []payloadRow{{User: u}}, false, true
+	}
+
+	env := &nocoEnvelope{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if err := dec.Decode(env); err != nil {
+		rejectPayload(w, decodeError(err))
+		return nil, true, false
+	}
+	if !has(nocoInsertEvents, env.Type) {
+		rejectPayload(w, ValidationError{{"type", fmt.Sprintf("unsupported event type %q", env.Type)}})
+		return nil, true, false
+	}
+	if len(env.Data.Rows) == 0 {
+		rejectPayload(w, ValidationError{{"data.rows", "is required"}})
+		return nil, true, false
+	}
+	log.Printf("[INFO] Received %s of %d row(s) from table %q.", env.Type, len(env.Data.Rows), env.Data.TableName)
+	for _, raw := range env.Data.Rows {
+		u, err := h.decodeUser(raw)
+		row := payloadRow{User: u}
+		if err != nil {
+			row.Errors = err.(ValidationError)
+		}
+		rows = append(rows, row)
+	}
+	return rows, true, true
+}
+
+func rejectPayload(w http.ResponseWriter, err error) {
+	log.Printf("[WARNING] Rejected onboarding payload: %v", err)
+	writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"errors": err,
+	})
+}
+
+// writeRowReport responds with the per-row results of an envelope, with the
+// given status if any row was accepted and 422 otherwise.
+func writeRowReport(w http.ResponseWriter, status, accepted int, results []RowResult) {
+	if accepted == 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"accepted": accepted,
+		"rows":     results,
+	})
+}
@@ -0,0 +1,81 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestPlanEnvelope(t *testing.T) {
+	h := &Handler{
+		Config: &Config{},
+		lookupUsername: func(username, email string) (bool, error) {
+			return false, nil
+		},
+	}
+	body := `{
+		"type": "records.after.bulkInsert",
+		"id": "8b7a3c",
+		"data": {
+			"table_id": "m1x",
+			"table_name": "Volunteers",
+			"rows": [
+				{"Id": 1, "telegram_handle": "jdoe", "Name": "Jane Doe", "Email": "jane@example.com", "skills": "Go"},
+				{"Id": 2, "telegram_handle": "nobody", "Name": "", "Email": "nobody@example.com", "skills": "Go"}
+			]
+		}
+	}`
+	w := httptest.NewRecorder()
+	h.Plan(w, httptest.NewRequest(http.MethodPost, "/user/provision/plan", strings.NewReader(body)), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Plan: status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var got struct {
+		Accepted int
+		Rows     []RowResult
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	want := []RowResult{
+		{Row: 0, Plan: &Plan{Username: "jdoe", Email: "jane@example.com", Name: "Jane Doe", FirstName: "Jane", LastName: "Doe", Account: &AccountProfile{Notifications: "disabled"}}},
+		{Row: 1, Errors: []FieldError{{"name", "is required"}}},
+	}
+	if got.Accepted != 1 {
+		t.Errorf("accepted = %d, want 1", got.Accepted)
+	}
+	if diff := cmp.Diff(want, got.Rows, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("Plan rows mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadPayloadsEnvelopeErrors(t *testing.T) {
+	h := &Handler{Config: &Config{}}
+	for _, tc := range []struct {
+		body string
+		want []FieldError
+	}{
+		{`{"type": "records.after.delete", "data": {"rows": [{}]}}`, []FieldError{{"type", `unsupported event type "records.after.delete"`}}},
+		{`{"type": "records.after.insert", "data": {"rows": []}}`, []FieldError{{"data.rows", "is required"}}},
+		{`{"type": "records.after.insert", "data": {"rows": {}}}`, []FieldError{{"data.rows", "must be an array, not an object"}}},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/user/provision/", strings.NewReader(tc.body))
+		if _, _, ok := h.readPayloads(w, req, nil); ok {
+			t.Errorf("readPayloads(%s) succeeded, want an error", tc.body)
+			continue
+		}
+		var got struct{ Errors []FieldError }
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		if diff := cmp.Diff(tc.want, got.Errors); diff != "" {
+			t.Errorf("readPayloads(%s) mismatch (-want +got):\n%s", tc.body, diff)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	mattermost "github.com/mattermost/mattermost-server/v6/model"
+	"github.com/xanzy/go-gitlab"
+	"gitlab.operationuplift.work/operations/development/janus/lib/actionlog"
+)
+
+// OffboardConfig configures offboarding from NocoDB record updates. Record
+// deletions always offboard the user.
+type OffboardConfig struct {
+	// StatusField is the NocoDB column holding the member status. If unset,
+	// updates are ignored.
+	StatusField string
+
+	// StatusValues are the statuses that offboard the member, e.g. "Left".
+	StatusValues []string
+}
+
+// nocoDeleteEvents and nocoUpdateEvents are the envelope types the
+// offboarding endpoint acts on.
+var (
+	nocoDeleteEvents = []string{"records.after.delete", "records.after.bulkDelete"}
+	nocoUpdateEvents = []string{"records.after.update", "records.after.bulkUpdate"}
+)
+
+// Offboard removes the posted users' access: their Gitlab account is
+// blocked and their Mattermost account deactivated, after removing them from
+// the groups, projects, teams and channels Janus manages and revoking their
+// tokens and sessions. It accepts a flat payload or a NocoDB envelope, and
+// answers with the action log. Users that are being provisioned, updated or
+// offboarded by another request are skipped, and the answer is a 409. If
+// anything else failed, the answer is a 500, so that the caller retries.
+func (h *Handler) Offboard(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if req.Body == nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	defer req.Body.Close()
+
+	users, err := h.offboardUsers(body)
+	if err != nil {
+		rejectPayload(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	failed := false
+	alog := &actionlog.Log{Title: "Offboarding users"}
+	for _, u := range users {
+		le := alog.Addf("user %s", u.Email)
+		unlock, ok := h.lockIdentity(u)
+		if !ok {
+			le.Errorf("another operation for this user is in progress, try again later")
+			status = http.StatusConflict
+			continue
+		}
+		h.offboard(u, le)
+		unlock()
+		failed = failed || le.HasErrors
+	}
+	if failed {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, alog)
+}
+
+// offboardUsers decodes the users to offboard from a request body. Errors
+// are ValidationErrors.
+func (h *Handler) offboardUsers(body []byte) ([]*OnboardingUser, error) {
+	decode := func(data []byte) (*OnboardingUser, error) {
+		u := &OnboardingUser{}
+		if err := json.Unmarshal(data, u); err != nil {
+			return nil, decodeError(err)
+		}
+		if msg := checkEmail(strings.TrimSpace(u.Email)); msg != "" {
+			return nil, ValidationError{{"email", msg}}
+		}
+		return u, nil
+	}
+	if !isEnvelope(body) {
+		u, err := decode(body)
+		if err != nil {
+			return nil, err
+		}
+		return []*OnboardingUser{u}, nil
+	}
+
+	env := &nocoEnvelope{}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(env); err != nil {
+		return nil, decodeError(err)
+	}
+	isDelete := has(nocoDeleteEvents, env.Type)
+	if !isDelete && !has(nocoUpdateEvents, env.Type) {
+		return nil, ValidationError{{"type", fmt.Sprintf("unsupported event type %q", env.Type)}}
+	}
+
+	var res []*OnboardingUser
+	for i, raw := range env.Data.Rows {
+		if !isDelete && !h.Config.Offboarding.offboards(raw) {
+			continue
+		}
+		u, err := decode(raw)
+		if err != nil {
+			verr := err.(ValidationError)
+			for j := range verr {
+				verr[j].Field = fmt.Sprintf("data.rows[%d].%s", i, verr[j].Field)
+			}
+			return nil, verr
+		}
+		res = append(res, u)
+	}
+	log.Printf("[INFO] Received %s of %d row(s) from table %q, %d to offboard.", env.Type, len(env.Data.Rows), env.Data.TableName, len(res))
+	return res, nil
+}
+
+// offboards reports whether an updated NocoDB row has an offboarding status.
+func (oc *OffboardConfig) offboards(row json.RawMessage) bool {
+	if oc.StatusField == "" {
+		return false
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(row, &fields); err != nil {
+		return false
+	}
+	status, _ := fields[oc.StatusField].(string)
+	for _, v := range oc.StatusValues {
+		if strings.EqualFold(v, strings.TrimSpace(status)) {
+			return true
+		}
+	}
+	return false
+}
+
+// offboard removes a single user's access, logging what it does. It keeps
+// going after errors, to remove as much access as possible.
+func (h *Handler) offboard(u *OnboardingUser, le *actionlog.Entity) {
+	log.Printf("[INFO] Offboarding %s.", u.Email)
+	h.offboardGitlab(u.Email, le)
+	h.offboardMattermost(u.Email, le)
+	if le.HasErrors {
+		log.Printf("[WARNING] Offboarding %s had errors.", u.Email)
+		return
+	}
+	if h.Jobs != nil {
+		if err := h.Jobs.Store.DeleteMember(u.Email); err != nil {
+			log.Printf("[WARNING] Forgetting member %s: %v", u.Email, err)
+		}
+	}
+}
+
+func (h *Handler) offboardGitlab(email string, le *actionlog.Entity) {
+	user, err := h.findGitlabUserByEmail(email)
+	if err != nil {
+		le.Errorf("searching gitlab user: %v", err)
+		return
+	}
+	if user == nil {
+		le.Logf("no gitlab account")
+		return
+	}
+	if user.IsAdmin {
+		le.Errorf("gitlab user %s is an admin, not offboarding it", user.Username)
+		return
+	}
+
+	for _, g := range h.Config.managedGitlab() {
+		var resp *gitlab.Response
+		var err error
+		what := fmt.Sprintf("group %q", g.Group)
+		if g.Group != "" {
+			resp, err = h.Gitlab.GroupMembers.RemoveGroupMember(g.Group, user.ID)
+		} else {
+			what = fmt.Sprintf("project %q", g.Project)
+			resp, err = h.Gitlab.ProjectMembers.DeleteProjectMember(g.Project, user.ID)
+		}
+		if ok, err := gitlabExists(resp, err); err != nil {
+			le.Errorf("removing gitlab user %s from %s: %v", user.Username, what, err)
+		} else if ok {
+			le.Logf("removed gitlab user %s from %s", user.Username, what)
+		}
+	}
+
+	h.revokeGitlabTokens(user.ID, le)
+
+	if user.State == "blocked" {
+		le.Logf("gitlab account was already blocked")
+		return
+	}
+	if err := h.Gitlab.Users.BlockUser(user.ID); err != nil {
+		le.Errorf("blocking gitlab account: %v", err)
+		return
+	}
+	le.Logf("gitlab account %s is now blocked", user.Username)
+}
+
+// tokensPerPage is the page size used when listing tokens.
+const tokensPerPage = 100
+
+// revokeGitlabTokens revokes the user's active impersonation and personal
+// access tokens.
+func (h *Handler) revokeGitlabTokens(uid int, le *actionlog.Entity) {
+	opts := &gitlab.GetAllImpersonationTokensOptions{
+		ListOptions: gitlab.ListOptions{PerPage: tokensPerPage},
+		State:       gitlab.String("active"),
+	}
+	for {
+		tokens, resp, err := h.Gitlab.Users.GetAllImpersonationTokens(uid, opts)
+		if err != nil {
+			le.Errorf("listing impersonation tokens: %v", err)
+			break
+		}
+		for _, t := range tokens {
+			if _, err := h.Gitlab.Users.RevokeImpersonationToken(uid, t.ID); err != nil {
+				le.Errorf("revoking impersonation token %q: %v", t.Name, err)
+				continue
+			}
+			le.Logf("revoked impersonation token %q", t.Name)
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	// go-gitlab cannot list or revoke other users' personal access tokens.
+	// Revoked tokens drop out of the active ones, so the first page is
+	// listed until it is empty, or nothing more can be revoked.
+	for {
+		var tokens []*gitlab.PersonalAccessToken
+		req, err := h.Gitlab.NewRequest(http.MethodGet, "personal_access_tokens", &struct {
+			gitlab.ListOptions
+			UserID int    `url:"user_id"`
+			State  string `url:"state"`
+		}{gitlab.ListOptions{PerPage: tokensPerPage}, uid, "active"}, nil)
+		if err == nil {
+			_, err = h.Gitlab.Do(req, &tokens)
+		}
+		if err != nil {
+			le.Errorf("listing personal access tokens: %v", err)
+			return
+		}
+		revoked := 0
+		for _, t := range tokens {
+			if err := h.revokePersonalAccessToken(t.ID); err != nil {
+				le.Errorf("revoking personal access token %q: %v", t.Name, err)
+				continue
+			}
+			revoked++
+			le.Logf("revoked personal access token %q", t.Name)
+		}
+		if len(tokens) < tokensPerPage || revoked == 0 {
+			return
+		}
+	}
+}
+
+func (h *Handler) revokePersonalAccessToken(id int) error {
+	req, err := h.Gitlab.NewRequest(http.MethodDelete, fmt.Sprintf("personal_access_tokens/%d", id), nil, nil)
+	if err != nil {
+		return err
+	}
+	_, err = h.Gitlab.Do(req, nil)
+	return err
+}
+
+func (h *Handler) offboardMattermost(email string, le *actionlog.Entity) {
+	user, resp, err := h.Mattermost.GetUserByEmail(email, "")
+	if err != nil {
+		if isNotFound(resp) {
+			le.Logf("no mattermost account")
+		} else {
+			le.Errorf("getting mattermost user: %v", err)
+		}
+		return
+	}
+
+	teams, err := h.teamGrants(h.Config.Rules)
+	if err != nil {
+		le.Errorf("resolving teams and channels: %v", err)
+	}
+	for _, tg := range teams {
+		for _, cg := range tg.Channels {
+			if ok, err := h.isChannelMember(cg.ID, user.Id); err != nil {
+				le.Errorf("checking channel %q membership: %v", cg.Channel, err)
+				continue
+			} else if !ok {
+				continue
+			}
+			if _, err := h.Mattermost.RemoveUserFromChannel(cg.ID, user.Id); err != nil {
+				le.Errorf("removing mattermost user %s from channel %q: %v", user.Username, cg.Channel, err)
+				continue
+			}
+			le.Logf("removed mattermost user %s from channel %q", user.Username, cg.Channel)
+		}
+		if ok, err := h.isTeamMember(tg.TeamID, user.Id); err != nil {
+			le.Errorf("checking team %q membership: %v", tg.Team, err)
+			continue
+		} else if !ok {
+			continue
+		}
+		if _, err := h.Mattermost.RemoveTeamMember(tg.TeamID, user.Id); err != nil {
+			le.Errorf("removing mattermost user %s from team %q: %v", user.Username, tg.Team, err)
+			continue
+		}
+		le.Logf("removed mattermost user %s from team %q", user.Username, tg.Team)
+	}
+
+	var tokens []*mattermost.UserAccessToken
+	for page := 0; ; page++ {
+		batch, _, err := h.Mattermost.GetUserAccessTokensForUser(user.Id, page, tokensPerPage)
+		if err != nil {
+			le.Errorf("listing access tokens: %v", err)
+			break
+		}
+		tokens = append(tokens, batch...)
+		if len(batch) < tokensPerPage {
+			break
+		}
+	}
+	for _, t := range tokens {
+		if !t.IsActive {
+			continue
+		}
+		if _, err := h.Mattermost.RevokeUserAccessToken(t.Id); err != nil {
+			le.Errorf("revoking access token %q: %v", t.Description, err)
+			continue
+		}
+		le.Logf("revoked access token %q", t.Description)
+	}
+	if _, err := h.Mattermost.RevokeAllSessions(user.Id); err != nil {
+		le.Errorf("revoking mattermost sessions: %v", err)
+	} else {
+		le.Logf("revoked all mattermost sessions")
+	}
+
+	if user.DeleteAt != 0 {
+		le.Logf("mattermost account was already deactivated")
+		return
+	}
+	if _, err := h.Mattermost.UpdateUserActive(user.Id, false); err != nil {
+		le.Errorf("deactivating mattermost account: %v", err)
+		return
+	}
+	le.Logf("mattermost account %s is now deactivated", user.Username)
+}
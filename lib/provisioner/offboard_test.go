@@ -0,0 +1,129 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/xanzy/go-gitlab"
+	"gitlab.operationuplift.work/operations/development/janus/lib/actionlog"
+)
+
+func TestOffboardUsers(t *testing.T) {
+	h := &Handler{Config: &Config{
+		Offboarding: OffboardConfig{StatusField: "Status", StatusValues: []string{"Left"}},
+	}}
+	for _, tc := range []struct {
+		desc    string
+		body    string
+		want    []string // emails
+		wantErr ValidationError
+	}{
+		{
+			desc: "flat",
+			body: `{"Email": "jane@example.com"}`,
+			want: []string{"jane@example.com"},
+		},
+		{
+			desc: "delete",
+			body: `{"type": "records.after.bulkDelete", "data": {"rows": [{"Email": "jane@example.com"}, {"Email": "joe@example.com"}]}}`,
+			want: []string{"jane@example.com", "joe@example.com"},
+		},
+		{
+			desc: "update",
+			body: `{"type": "records.after.update", "data": {"rows": [{"Email": "jane@example.com", "Status": "left "}, {"Email": "joe@example.com", "Status": "Active"}]}}`,
+			want: []string{"jane@example.com"},
+		},
+		{
+			desc:    "insert",
+			body:    `{"type": "records.after.insert", "data": {"rows": [{"Email": "jane@example.com"}]}}`,
+			wantErr: ValidationError{{"type", `unsupported event type "records.after.insert"`}},
+		},
+		{
+			desc:    "bad email",
+			body:    `{"type": "records.after.delete", "data": {"rows": [{"Email": "jane"}]}}`,
+			wantErr: ValidationError{{"data.rows[0].email", "must be a plain email address, like jane@example.com"}},
+		},
+	} {
+		users, err := h.offboardUsers([]byte(tc.body))
+		var got []string
+		for _, u := range users {
+			got = append(got, u.Email)
+		}
+		var gotErr ValidationError
+		if err != nil {
+			gotErr = err.(ValidationError)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: offboardUsers mismatch (-want +got):\n%s", tc.desc, diff)
+		}
+		if diff := cmp.Diff(tc.wantErr, gotErr); diff != "" {
+			t.Errorf("%s: offboardUsers error mismatch (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+
+	h.Config.Offboarding = OffboardConfig{}
+	users, err := h.offboardUsers([]byte(`{"type": "records.after.update", "data": {"rows": [{"Email": "jane@example.com", "Status": "Left"}]}}`))
+	if err != nil || len(users) != 0 {
+		t.Errorf("offboardUsers without status field = %v, %v; want nothing", users, err)
+	}
+}
+
+func TestRevokeGitlabTokens(t *testing.T) {
+	// User 7 has three impersonation tokens, served one per page, and three
+	// personal access tokens.
+	revoked := map[string]bool{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/users/7/impersonation_tokens", func(w http.ResponseWriter, req *http.Request) {
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		if page < 3 {
+			w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+		}
+		json.NewEncoder(w).Encode([]*gitlab.ImpersonationToken{{ID: page, Name: fmt.Sprintf("imp%d", page)}})
+	})
+	mux.HandleFunc("/api/v4/users/7/impersonation_tokens/", func(w http.ResponseWriter, req *http.Request) {
+		revoked["imp"+strings.TrimPrefix(req.URL.Path, "/api/v4/users/7/impersonation_tokens/")] = req.Method == http.MethodDelete
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/api/v4/personal_access_tokens", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("user_id") != "7" || req.URL.Query().Get("state") != "active" {
+			t.Errorf("listing personal access tokens with query %q", req.URL.RawQuery)
+		}
+		tokens := []*gitlab.PersonalAccessToken{}
+		for i := 1; i <= 3; i++ {
+			if !revoked[fmt.Sprintf("pat%d", i)] {
+				tokens = append(tokens, &gitlab.PersonalAccessToken{ID: i, Name: fmt.Sprintf("pat%d", i)})
+			}
+		}
+		json.NewEncoder(w).Encode(tokens)
+	})
+	mux.HandleFunc("/api/v4/personal_access_tokens/", func(w http.ResponseWriter, req *http.Request) {
+		revoked["pat"+strings.TrimPrefix(req.URL.Path, "/api/v4/personal_access_tokens/")] = req.Method == http.MethodDelete
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client, err := gitlab.NewClient("token", gitlab.WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("creating gitlab client: %v", err)
+	}
+
+	h := &Handler{Gitlab: client}
+	le := &actionlog.Entity{Name: "user jane@example.com"}
+	h.revokeGitlabTokens(7, le)
+	if le.HasErrors {
+		t.Errorf("revokeGitlabTokens had errors: %+v", le.Log)
+	}
+	want := map[string]bool{"imp1": true, "imp2": true, "imp3": true, "pat1": true, "pat2": true, "pat3": true}
+	if diff := cmp.Diff(want, revoked); diff != "" {
+		t.Error("Unexpected revoked tokens (-want +got):\n", diff)
+	}
+}
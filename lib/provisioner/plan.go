@@ -0,0 +1,230 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// Plan describes everything provisioning does for a user. The provisioning
+// pipeline executes a plan, and the dry-run endpoint returns it as is.
+type Plan struct {
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	Name      string `json:"name"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+
+	Gitlab []GitlabGrant `json:"gitlab"` // groups and projects to join.
+	Rules  []RuleMatch   `json:"rules"`  // rules matching the user's skills.
+	Teams  []TeamGrant   `json:"teams"`  // teams and channels to join, deduplicated.
+
+	Account *AccountProfile `json:"account"` // settings of the Gitlab account.
+
+	EmailVariables map[string]string `json:"emailVariables"`
+	WelcomeMessage string            `json:"welcomeMessage,omitempty"` // direct message from the bot.
+
+	Checklist    *ChecklistIssue `json:"checklist,omitempty"`    // onboarding checklist issue to open.
+	ChecklistURL string          `json:"checklistURL,omitempty"` // set once the issue is open.
+}
+
+// RuleMatch is a rule that matched the user, with what it grants.
+type RuleMatch struct {
+	Name     string        `json:"name"`
+	Team     string        `json:"team,omitempty"`
+	Channels []string      `json:"channels,omitempty"`
+	Gitlab   []GitlabGrant `json:"gitlab,omitempty"`
+}
+
+// TeamGrant is a Mattermost team membership, with the team's channels.
+type TeamGrant struct {
+	Team     string         `json:"team"`
+	TeamID   string         `json:"teamID"`
+	Channels []ChannelGrant `json:"channels"`
+}
+
+// ChannelGrant is a Mattermost channel membership.
+type ChannelGrant struct {
+	Channel string `json:"channel"`
+	ID      string `json:"id"`
+}
+
+// DryRun validates the payload and works out what provisioning the user
+// entails, without making any changes. Invalid payloads are reported as a
+// ValidationError.
+func (h *Handler) DryRun(payload *OnboardingUser) (*Plan, error) {
+	if err := h.Config.CheckPayload(payload); err != nil {
+		return nil, err
+	}
+	return h.plan(payload)
+}
+
+// plan works out what provisioning the user entails, without making any
+// changes.
+func (h *Handler) plan(payload *OnboardingUser) (*Plan, error) {
+	first, last, err := splitName(payload.Name)
+	if err != nil {
+		return nil, err
+	}
+	// The username is settled before anything is created, so that an
+	// unusable handle cannot leave behind half-provisioned accounts.
+	username, err := h.Config.Usernames.chooseUsername(payload.TelegramHandle, payload.Email, func(name string) (bool, error) {
+		return h.usernameTaken(name, payload.Email)
+	})
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{
+		Username:  username,
+		Email:     payload.Email,
+		Name:      payload.Name,
+		FirstName: first,
+		LastName:  last,
+	}
+	rules := h.Config.MatchingRules(payload)
+	today := time.Now()
+	p.Account = h.Config.accountProfile(rules)
+	p.Account.Expires = expiryDate(p.Account.Expires, today)
+
+	if h.Config.GitlabGroup != "" {
+		p.addGitlab(GitlabGrant{
+			Group:  h.Config.GitlabGroup,
+			Access: AccessLevel(gitlab.DeveloperPermissions),
+		}, today)
+	}
+	if h.Config.GitlabProject != "" {
+		p.addGitlab(GitlabGrant{
+			Project: h.Config.GitlabProject,
+			Access:  AccessLevel(gitlab.DeveloperPermissions),
+		}, today)
+	}
+
+	for _, rule := range rules {
+		match := RuleMatch{
+			Name:     rule.Name,
+			Team:     rule.Team,
+			Channels: rule.Channels,
+		}
+		for _, g := range rule.Gitlab {
+			match.Gitlab = append(match.Gitlab, p.addGitlab(g, today))
+		}
+		p.Rules = append(p.Rules, match)
+	}
+	if p.Teams, err = h.teamGrants(rules); err != nil {
+		return nil, err
+	}
+
+	if p.Checklist, err = h.checklistIssue(p, payload, rules); err != nil {
+		return nil, err
+	}
+	if p.EmailVariables, err = h.emailVariables(p); err != nil {
+		return nil, err
+	}
+	if p.WelcomeMessage, err = h.welcomeMessage(p, rules); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// teamGrants returns the Mattermost teams and channels the rules grant,
+// deduplicated, in the order the rules name them.
+func (h *Handler) teamGrants(rules []Rule) ([]TeamGrant, error) {
+	var res []TeamGrant
+	teams := map[string]int{} // team to index in res
+	for _, rule := range rules {
+		if rule.Team == "" {
+			continue
+		}
+		i, ok := teams[rule.Team]
+		if !ok {
+			id, err := h.Names.Team(rule.Team)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+			}
+			i = len(res)
+			teams[rule.Team] = i
+			res = append(res, TeamGrant{Team: rule.Team, TeamID: id})
+		}
+		tg := &res[i]
+		for _, channel := range rule.Channels {
+			if tg.hasChannel(channel) {
+				continue
+			}
+			id, err := h.Names.Channel(tg.TeamID, channel)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+			}
+			tg.Channels = append(tg.Channels, ChannelGrant{Channel: channel, ID: id})
+		}
+	}
+	return res, nil
+}
+
+// addGitlab adds a Gitlab membership to the plan, with its expiry resolved
+// to a date. If the plan already has a membership for the same group or
+// project, the one with the higher access level wins; for equal levels, the
+// later expiry wins. It returns the grant with the resolved expiry.
+func (p *Plan) addGitlab(g GitlabGrant, today time.Time) GitlabGrant {
+	g.Expires = g.expiryDate(today)
+	for i, old := range p.Gitlab {
+		if old.Group != g.Group || old.Project != g.Project {
+			continue
+		}
+		if g.Access > old.Access || g.Access == old.Access && laterExpiry(g.Expires, old.Expires) {
+			p.Gitlab[i] = g
+		}
+		return g
+	}
+	p.Gitlab = append(p.Gitlab, g)
+	return g
+}
+
+// laterExpiry reports whether expiry date a is later than b. An empty date
+// never expires.
+func laterExpiry(a, b string) bool {
+	if a == "" || b == "" {
+		return a == "" && b != ""
+	}
+	return a > b
+}
+
+func (tg *TeamGrant) hasChannel(name string) bool {
+	for _, c := range tg.Channels {
+		if c.Channel == name {
+			return true
+		}
+	}
+	return false
+}
+
+// splitName splits a full name into first and last name, the last name
+// being the last word.
+func splitName(name string) (first, last string, _ error) {
+	parts := strings.Fields(name)
+	if len(parts) == 0 {
+		return "", "", permanent(errors.New("field name is required"))
+	}
+	return strings.Join(parts[:len(parts)-1], " "), parts[len(parts)-1], nil
+}
+
+// permanentError marks a failure that retrying cannot fix, like a payload
+// without a usable username.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err}
+}
+
+// isPermanent reports whether err, or any error it wraps, is permanent.
+func isPermanent(err error) bool {
+	var perr *permanentError
+	return errors.As(err, &perr)
+}
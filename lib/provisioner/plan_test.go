@@ -0,0 +1,87 @@
+package provisioner
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestPlan(t *testing.T) {
+	h := &Handler{
+		GitlabURL:     "https://gitlab.example.com/",
+		MattermostURL: "https://chat.example.com",
+		lookupUsername: func(username, email string) (bool, error) {
+			return false, nil
+		},
+	}
+	h.Config = &Config{
+		GitlabGroup:            "some group",
+		MailgunWelcomeTemplate: "welcome",
+		WelcomeVariables: map[string]string{
+			"first":    "{{.FirstName}}",
+			"channels": `{{join .Channels ", "}}`,
+			"rules":    `{{join .Rules ", "}}`,
+			"links":    "{{.GitlabURL}} {{.MattermostURL}} {{.PasswordURL}}",
+		},
+		Rules: []Rule{
+			{Name: "coders", Skill: "Programming", Team: "team1", Channels: []string{"dev", "general"}},
+			{Name: "analysts", Skill: "Data analysis", Team: "team1", Channels: []string{"general", "data"}, Gitlab: []GitlabGrant{
+				{Group: "analytics", Access: AccessLevel(gitlab.ReporterPermissions), Expires: "2030-01-31"},
+				{Group: "some group", Access: AccessLevel(gitlab.MaintainerPermissions)},
+			}},
+			{Name: "designers", Skill: "Design", Team: "team2", Channels: []string{"design"}},
+		},
+	}
+	if err := h.Config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	got, err := h.plan(&OnboardingUser{
+		TelegramHandle: "@JDoe",
+		Name:           "Jane  Mary Doe",
+		Email:          "jane@example.com",
+		RawSkills:      "Programming,Data analysis",
+	})
+	if err != nil {
+		t.Fatalf("plan failed: %v", err)
+	}
+	want := &Plan{
+		Username:  "jdoe",
+		Email:     "jane@example.com",
+		Name:      "Jane  Mary Doe",
+		FirstName: "Jane Mary",
+		LastName:  "Doe",
+		Gitlab: []GitlabGrant{
+			{Group: "some group", Access: AccessLevel(gitlab.MaintainerPermissions)},
+			{Group: "analytics", Access: AccessLevel(gitlab.ReporterPermissions), Expires: "2030-01-31"},
+		},
+		Rules: []RuleMatch{
+			{Name: "coders", Team: "team1", Channels: []string{"dev", "general"}},
+			{Name: "analysts", Team: "team1", Channels: []string{"general", "data"}, Gitlab: []GitlabGrant{
+				{Group: "analytics", Access: AccessLevel(gitlab.ReporterPermissions), Expires: "2030-01-31"},
+				{Group: "some group", Access: AccessLevel(gitlab.MaintainerPermissions)},
+			}},
+		},
+		Teams: []TeamGrant{
+			{Team: "team1", TeamID: "team1", Channels: []ChannelGrant{
+				{Channel: "dev", ID: "dev"},
+				{Channel: "general", ID: "general"},
+				{Channel: "data", ID: "data"},
+			}},
+		},
+		Account: &AccountProfile{Notifications: "disabled"},
+		EmailVariables: map[string]string{
+			"first":    "Jane Mary",
+			"channels": "dev, general, data",
+			"rules":    "coders, analysts",
+			"links":    "https://gitlab.example.com/users/sign_in https://chat.example.com/login https://gitlab.example.com/users/password/new",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("Unexpected plan diff (-want +got):\n", diff)
+	}
+
+	if _, err := h.plan(&OnboardingUser{Name: "  "}); err == nil {
+		t.Error("plan succeeded for blank name, want error")
+	}
+}
@@ -0,0 +1,283 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// AccountProfile configures the Gitlab accounts of provisioned users. Unset
+// fields keep Gitlab's defaults, except Notifications.
+type AccountProfile struct {
+	// Notifications is the global notification level: disabled,
+	// participating, watch, global, mention or custom. Defaults to disabled.
+	// Unlike the other settings, it applies to reused accounts as well.
+	Notifications string
+
+	ProjectsLimit  *int  // number of personal projects the user may create.
+	CanCreateGroup *bool // the user may create top level groups.
+	External       *bool // external users only see projects they are members of.
+
+	Theme       string // navigation theme, by name (e.g. "indigo", "dark-mode") or ID.
+	ColorScheme string // syntax highlighting scheme, by name (e.g. "monokai") or ID.
+
+	// Expires is when the account expires, as YYYY-MM-DD or a number of
+	// days after provisioning like "365d". Gitlab has no account expiry of
+	// its own, so the Reconciler blocks expired accounts; it requires a
+	// reconciliation interval. The plan holds the resolved date.
+	Expires string
+}
+
+var (
+	gitlabThemes = map[string]int{
+		"indigo": 1, "dark": 2, "light": 3, "blue": 4, "green": 5,
+		"light-indigo": 6, "light-blue": 7, "light-green": 8,
+		"red": 9, "light-red": 10, "dark-mode": 11,
+	}
+	gitlabColorSchemes = map[string]int{
+		"white": 1, "dark": 2, "solarized-light": 3, "solarized-dark": 4,
+		"monokai": 5, "none": 6,
+	}
+	notificationLevels = []string{"disabled", "participating", "watch", "global", "mention", "custom"}
+)
+
+// validate checks the profile values.
+func (ap *AccountProfile) validate() error {
+	if ap.Notifications != "" && !has(notificationLevels, ap.Notifications) {
+		return fmt.Errorf("notifications: unknown level %q (want one of %s)", ap.Notifications, strings.Join(notificationLevels, ", "))
+	}
+	if ap.ProjectsLimit != nil && *ap.ProjectsLimit < 0 {
+		return errors.New("projectsLimit: must not be negative")
+	}
+	if _, err := lookupID(gitlabThemes, ap.Theme); err != nil {
+		return fmt.Errorf("theme: %w", err)
+	}
+	if _, err := lookupID(gitlabColorSchemes, ap.ColorScheme); err != nil {
+		return fmt.Errorf("colorScheme: %w", err)
+	}
+	if err := validateExpiry(ap.Expires); err != nil {
+		return fmt.Errorf("expires: %w", err)
+	}
+	return nil
+}
+
+// lookupID resolves a theme or color scheme given by name or ID. Empty
+// values resolve to 0.
+func lookupID(ids map[string]int, v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if id, ok := ids[strings.ToLower(v)]; ok {
+		return id, nil
+	}
+	if id, err := strconv.Atoi(v); err == nil && id > 0 {
+		return id, nil
+	}
+	return 0, fmt.Errorf("unknown value %q", v)
+}
+
+// accountProfile returns the profile for a user matching the given rules,
+// which are in priority order. Each field comes from the highest priority
+// rule that sets it, or else from the global profile.
+func (c *Config) accountProfile(rules []Rule) *AccountProfile {
+	res := &AccountProfile{}
+	profiles := make([]*AccountProfile, 0, len(rules)+1)
+	for _, r := range rules {
+		if r.Account != nil {
+			profiles = append(profiles, r.Account)
+		}
+	}
+	profiles = append(profiles, &c.Account)
+	for i := len(profiles) - 1; i >= 0; i-- {
+		res.merge(profiles[i])
+	}
+	if res.Notifications == "" {
+		res.Notifications = "disabled"
+	}
+	return res
+}
+
+// merge overrides the fields of ap with the ones set in other.
+func (ap *AccountProfile) merge(other *AccountProfile) {
+	if other.Notifications != "" {
+		ap.Notifications = other.Notifications
+	}
+	if other.ProjectsLimit != nil {
+		ap.ProjectsLimit = other.ProjectsLimit
+	}
+	if other.CanCreateGroup != nil {
+		ap.CanCreateGroup = other.CanCreateGroup
+	}
+	if other.External != nil {
+		ap.External = other.External
+	}
+	if other.Theme != "" {
+		ap.Theme = other.Theme
+	}
+	if other.ColorScheme != "" {
+		ap.ColorScheme = other.ColorScheme
+	}
+	if other.Expires != "" {
+		ap.Expires = other.Expires
+	}
+}
+
+// expiresAccounts reports whether the global profile or any rule's sets an
+// account expiry.
+func (c *Config) expiresAccounts() bool {
+	if c.Account.Expires != "" {
+		return true
+	}
+	for _, r := range c.Rules {
+		if r.Account != nil && r.Account.Expires != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// applyAccountProfile applies the profile to a Gitlab account. Accounts that
+// were already there only get the notification level: the other settings are
+// for accounts provisioning created. The expiry is not a Gitlab setting, it
+// is recorded with the member once provisioning succeeds. Each setting is a
+// step of its own.
+// Failing ones are reported, but do not fail provisioning: the account is
+// usable with Gitlab's defaults.
+func (h *Handler) applyAccountProfile(ap *AccountProfile, uid int, created bool, tx *txn) {
+	setting := func(name string, fn func() error) {
+		_ = tx.do("gitlab: set "+name, func() (func() error, error) {
+			if err := fn(); err != nil {
+				log.Printf("[WARNING] Setting %s of gitlab user %d: %v", name, uid, err)
+				return nil, err
+			}
+			return nil, nil
+		})
+	}
+	modify := func(opts *gitlab.ModifyUserOptions) error {
+		_, _, err := h.Gitlab.Users.ModifyUser(uid, opts)
+		return err
+	}
+
+	if !created {
+		ap = &AccountProfile{Notifications: ap.Notifications}
+	}
+	if ap.ProjectsLimit != nil {
+		setting(fmt.Sprintf("projects limit to %d", *ap.ProjectsLimit), func() error {
+			return modify(&gitlab.ModifyUserOptions{ProjectsLimit: ap.ProjectsLimit})
+		})
+	}
+	if ap.CanCreateGroup != nil {
+		setting(fmt.Sprintf("can create group to %t", *ap.CanCreateGroup), func() error {
+			return modify(&gitlab.ModifyUserOptions{CanCreateGroup: ap.CanCreateGroup})
+		})
+	}
+	if ap.External != nil {
+		setting(fmt.Sprintf("external to %t", *ap.External), func() error {
+			return modify(&gitlab.ModifyUserOptions{External: ap.External})
+		})
+	}
+	// go-gitlab has no options for the theme and color scheme.
+	if ap.Theme != "" {
+		setting(fmt.Sprintf("theme to %s", ap.Theme), func() error {
+			id, _ := lookupID(gitlabThemes, ap.Theme)
+			return h.putGitlabUser(uid, map[string]int{"theme_id": id})
+		})
+	}
+	if ap.ColorScheme != "" {
+		setting(fmt.Sprintf("color scheme to %s", ap.ColorScheme), func() error {
+			id, _ := lookupID(gitlabColorSchemes, ap.ColorScheme)
+			return h.putGitlabUser(uid, map[string]int{"color_scheme_id": id})
+		})
+	}
+
+	// Settings of the user's own, which need impersonation, share a token.
+	imp := &impersonation{h: h, uid: uid}
+	defer imp.close()
+	setting(fmt.Sprintf("notification level to %s", ap.Notifications), func() error {
+		client, err := imp.client()
+		if err != nil {
+			return err
+		}
+		_, _, err = client.NotificationSettings.UpdateGlobalSettings(&gitlab.NotificationSettingsOptions{
+			Level: gitlab.NotificationLevel(notificationLevel(ap.Notifications)),
+		})
+		return err
+	})
+}
+
+func notificationLevel(name string) gitlab.NotificationLevelValue {
+	for _, l := range []gitlab.NotificationLevelValue{
+		gitlab.DisabledNotificationLevel,
+		gitlab.ParticipatingNotificationLevel,
+		gitlab.WatchNotificationLevel,
+		gitlab.GlobalNotificationLevel,
+		gitlab.MentionNotificationLevel,
+		gitlab.CustomNotificationLevel,
+	} {
+		if l.String() == name {
+			return l
+		}
+	}
+	return gitlab.DisabledNotificationLevel
+}
+
+// putGitlabUser modifies user attributes that go-gitlab does not know about.
+func (h *Handler) putGitlabUser(uid int, attrs interface{}) error {
+	req, err := h.Gitlab.NewRequest(http.MethodPut, fmt.Sprintf("users/%d", uid), attrs, nil)
+	if err != nil {
+		return err
+	}
+	_, err = h.Gitlab.Do(req, nil)
+	return err
+}
+
+// impersonation creates a short-lived impersonation token for a user on
+// first use, and revokes it on close.
+type impersonation struct {
+	h     *Handler
+	uid   int
+	token *gitlab.ImpersonationToken
+	sub   *gitlab.Client
+}
+
+func (imp *impersonation) client() (*gitlab.Client, error) {
+	if imp.sub != nil {
+		return imp.sub, nil
+	}
+	h := imp.h
+	token, _, err := h.Gitlab.Users.CreateImpersonationToken(imp.uid, &gitlab.CreateImpersonationTokenOptions{
+		Name:      gitlab.String("provisioning-token"),
+		Scopes:    strListPtr("api"),
+		ExpiresAt: timePtr(time.Now().Add(24 * time.Hour)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating impersonation token: %w", err)
+	}
+	log.Printf("[INFO] Created impersonation token %d for user %d", token.ID, imp.uid)
+	imp.token = token
+
+	sub, err := gitlab.NewClient(token.Token, gitlab.WithBaseURL(h.Gitlab.BaseURL().String()))
+	if err != nil {
+		return nil, fmt.Errorf("creating user-specific subclient: %w", err)
+	}
+	imp.sub = sub
+	return sub, nil
+}
+
+// close revokes the token, if one was created.
+func (imp *impersonation) close() {
+	if imp.token == nil {
+		return
+	}
+	if _, err := imp.h.Gitlab.Users.RevokeImpersonationToken(imp.uid, imp.token.ID); err != nil {
+		log.Printf("[ERROR] Revoking impersonation token %d for user %d: %v", imp.token.ID, imp.uid, err)
+		return
+	}
+	log.Printf("[INFO] Revoked impersonation token %d for user %d.", imp.token.ID, imp.uid)
+}
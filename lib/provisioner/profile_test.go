@@ -0,0 +1,205 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestAccountProfile(t *testing.T) {
+	h := &Handler{
+		lookupUsername: func(username, email string) (bool, error) {
+			return false, nil
+		},
+	}
+	h.Config = &Config{
+		GitlabGroup: "all",
+		Account: AccountProfile{
+			ProjectsLimit: gitlab.Int(0),
+			External:      gitlab.Bool(true),
+			Theme:         "dark-mode",
+		},
+		Rules: []Rule{
+			{Name: "coders", Skill: "Programming", Account: &AccountProfile{
+				ProjectsLimit:  gitlab.Int(10),
+				CanCreateGroup: gitlab.Bool(false),
+				Theme:          "indigo",
+			}},
+			{Name: "staff", EmailDomains: []string{"staff.example.com"}, Priority: 1, Account: &AccountProfile{
+				Notifications: "participating",
+				External:      gitlab.Bool(false),
+				Theme:         "4",
+			}},
+			{Name: "interns", Skill: "Internship", Account: &AccountProfile{Expires: "90d"}},
+		},
+		Reconcile: ReconcileConfig{Interval: Duration{time.Hour}},
+	}
+	if err := h.Config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name, email, skills string
+		want                *AccountProfile
+	}{
+		{
+			name:   "global",
+			email:  "jane@example.com",
+			skills: "Design",
+			want: &AccountProfile{
+				Notifications: "disabled",
+				ProjectsLimit: gitlab.Int(0),
+				External:      gitlab.Bool(true),
+				Theme:         "dark-mode",
+			},
+		},
+		{
+			name:   "rule",
+			email:  "jane@example.com",
+			skills: "Programming",
+			want: &AccountProfile{
+				Notifications:  "disabled",
+				ProjectsLimit:  gitlab.Int(10),
+				CanCreateGroup: gitlab.Bool(false),
+				External:       gitlab.Bool(true),
+				Theme:          "indigo",
+			},
+		},
+		{
+			name:   "rules by priority",
+			email:  "jane@staff.example.com",
+			skills: "Programming",
+			want: &AccountProfile{
+				Notifications:  "participating",
+				ProjectsLimit:  gitlab.Int(10),
+				CanCreateGroup: gitlab.Bool(false),
+				External:       gitlab.Bool(false),
+				Theme:          "4",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := h.plan(&OnboardingUser{Name: "Jane Doe", Email: tc.email, RawSkills: tc.skills})
+			if err != nil {
+				t.Fatalf("plan failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, p.Account); diff != "" {
+				t.Error("Unexpected account profile diff (-want +got):\n", diff)
+			}
+		})
+	}
+
+	t.Run("expiry", func(t *testing.T) {
+		p, err := h.plan(&OnboardingUser{Name: "Jane Doe", Email: "jane@example.com", RawSkills: "Internship"})
+		if err != nil {
+			t.Fatalf("plan failed: %v", err)
+		}
+		if want := time.Now().AddDate(0, 0, 90).Format(dateFormat); p.Account.Expires != want {
+			t.Errorf("account expires %q, want %q", p.Account.Expires, want)
+		}
+		for _, g := range p.Gitlab {
+			if g.Expires != "" {
+				t.Errorf("membership of %s%s expires %q, want no expiry", g.Group, g.Project, g.Expires)
+			}
+		}
+	})
+
+	t.Run("expiry without reconciliation", func(t *testing.T) {
+		c := &Config{Account: AccountProfile{Expires: "90d"}}
+		if err := c.Validate(); err == nil {
+			t.Error("Validate succeeded, want an error about the reconcile interval")
+		}
+	})
+}
+
+func TestAccountProfileValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		profile AccountProfile
+		wantErr bool
+	}{
+		{name: "empty", profile: AccountProfile{}},
+		{name: "names", profile: AccountProfile{Notifications: "watch", Theme: "Light-Blue", ColorScheme: "solarized-dark", Expires: "2030-01-31"}},
+		{name: "IDs", profile: AccountProfile{Theme: "11", ColorScheme: "5", Expires: "30d"}},
+		{name: "unknown notification level", profile: AccountProfile{Notifications: "loud"}, wantErr: true},
+		{name: "unknown theme", profile: AccountProfile{Theme: "purple"}, wantErr: true},
+		{name: "invalid color scheme", profile: AccountProfile{ColorScheme: "-1"}, wantErr: true},
+		{name: "negative projects limit", profile: AccountProfile{ProjectsLimit: gitlab.Int(-1)}, wantErr: true},
+		{name: "invalid expiry", profile: AccountProfile{Expires: "next year"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.profile.validate()
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("validate() = %v, want error: %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyAccountProfile(t *testing.T) {
+	var got []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/users/7", func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		got = append(got, strings.TrimSpace(string(body)))
+		json.NewEncoder(w).Encode(&gitlab.User{ID: 7})
+	})
+	mux.HandleFunc("/api/v4/users/7/impersonation_tokens", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(&gitlab.ImpersonationToken{ID: 1, Token: "imp"})
+	})
+	mux.HandleFunc("/api/v4/users/7/impersonation_tokens/1", func(w http.ResponseWriter, req *http.Request) {
+		got = append(got, "revoke token")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/api/v4/notification_settings", func(w http.ResponseWriter, req *http.Request) {
+		var opts struct{ Level string }
+		json.NewDecoder(req.Body).Decode(&opts)
+		got = append(got, "notifications "+opts.Level)
+		json.NewEncoder(w).Encode(&gitlab.NotificationSettings{})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client, err := gitlab.NewClient("token", gitlab.WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("creating gitlab client: %v", err)
+	}
+	h := &Handler{Gitlab: client}
+	ap := &AccountProfile{Notifications: "watch", ProjectsLimit: gitlab.Int(5), Theme: "dark-mode"}
+
+	for _, tc := range []struct {
+		name    string
+		created bool
+		want    []string
+	}{
+		{
+			name:    "created",
+			created: true,
+			want:    []string{`{"projects_limit":5}`, `{"theme_id":11}`, "notifications watch", "revoke token"},
+		},
+		{
+			name: "reused",
+			want: []string{"notifications watch", "revoke token"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got = nil
+			tx := newTxn()
+			h.applyAccountProfile(ap, 7, tc.created, tx)
+			for _, step := range tx.res.Steps {
+				if step.Error != "" {
+					t.Errorf("step %q failed: %s", step.Name, step.Error)
+				}
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Error("Unexpected Gitlab calls (-want +got):\n", diff)
+			}
+		})
+	}
+}
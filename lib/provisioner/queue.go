@@ -0,0 +1,283 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// busyDelay is how long a job waits when its user is busy with another
+// operation.
+const busyDelay = 5 * time.Second
+
+// Queue runs provisioning jobs in the background, retrying failed ones with
+// exponential backoff.
+type Queue struct {
+	Handler *Handler
+	Store   *Store
+	Config  QueueConfig
+
+	wake chan struct{}
+}
+
+// NewQueue creates a job queue, filling in defaults for unset config values.
+func NewQueue(h *Handler, store *Store, cfg QueueConfig) *Queue {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 8
+	}
+	if cfg.Backoff.Duration <= 0 {
+		cfg.Backoff.Duration = 30 * time.Second
+	}
+	if cfg.MaxBackoff.Duration <= 0 {
+		cfg.MaxBackoff.Duration = time.Hour
+	}
+	return &Queue{
+		Handler: h,
+		Store:   store,
+		Config:  cfg,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Enqueue persists a new job for the given payload and wakes up a worker.
+// Jobs that need approval wait for it instead. If a job for the same email
+// is waiting and has not started, the payload replaces its own and that job
+// is returned. Other active jobs for the same email or username make it fail
+// with ErrBusy.
+func (q *Queue) Enqueue(payload *OnboardingUser) (*Job, error) {
+	needsApproval := q.Handler.Config.needsApproval(payload)
+	job := &Job{
+		State:       JobPending,
+		Payload:     payload,
+		NextAttempt: time.Now(),
+	}
+	if needsApproval {
+		job.State = JobAwaitingApproval
+	}
+	existing, err := q.Store.addUnlessActive(job, func(other *Job) error {
+		sameEmail := string(memberKey(other.Payload.Email)) == string(memberKey(payload.Email))
+		if !sameEmail || other.State == JobRunning || other.started() {
+			return busyError(other)
+		}
+		other.Payload = payload
+		if needsApproval && other.State == JobPending {
+			other.State = JobAwaitingApproval
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, ErrBusy):
+		log.Printf("[INFO] Not queueing provisioning of %s: %v", payload.Email, err)
+		return nil, err
+	case err != nil:
+		return nil, fmt.Errorf("storing job: %w", err)
+	case existing != nil:
+		log.Printf("[INFO] Provisioning of %s is already %s as job %d, merged the new request into it.", payload.Email, existing.State, existing.ID)
+		return existing, nil
+	}
+	if job.State == JobAwaitingApproval {
+		log.Printf("[INFO] Provisioning job %d for %s is awaiting approval.", job.ID, payload.Email)
+		return job, nil
+	}
+	log.Printf("[INFO] Queued provisioning job %d for %s.", job.ID, payload.Email)
+	q.notify()
+	return job, nil
+}
+
+// Run provisions the payload right away, as a job approved by the given
+// user, and returns the job once the attempt is over. Like any other job, it
+// is retried in the background if the attempt fails. If the user already has
+// an active job, it fails with ErrBusy.
+func (q *Queue) Run(ctx context.Context, payload *OnboardingUser, by string) (*Job, error) {
+	now := time.Now()
+	job := &Job{
+		State:       JobRunning, // keeps the workers away.
+		Payload:     payload,
+		NextAttempt: now,
+		Review:      &Review{By: by, At: now, Approved: true},
+	}
+	if _, err := q.Store.addUnlessActive(job, busyError); err != nil {
+		if errors.Is(err, ErrBusy) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("storing job: %w", err)
+	}
+	log.Printf("[INFO] Running provisioning job %d for %s, started by %s.", job.ID, payload.Email, by)
+	q.process(ctx, job)
+	return job, nil
+}
+
+// busyError reports that the user has another active job.
+func busyError(other *Job) error {
+	return fmt.Errorf("job %d for %s is %s: %w", other.ID, other.Payload.Email, other.State, ErrBusy)
+}
+
+// Start requeues jobs interrupted by a previous shutdown and starts the
+// workers. They stop when ctx is done.
+func (q *Queue) Start(ctx context.Context) error {
+	if err := q.Store.requeueRunning(); err != nil {
+		return fmt.Errorf("requeueing interrupted jobs: %w", err)
+	}
+	for i := 0; i < q.Config.Workers; i++ {
+		go q.work(ctx)
+	}
+	return nil
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) work(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		job, err := q.Store.claim(time.Now())
+		if err != nil {
+			log.Printf("[ERROR] Claiming provisioning job: %v", err)
+		}
+		if job != nil {
+			q.process(ctx, job)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// process runs a single attempt of the job and stores the outcome. If
+// another operation for the same user is in progress, the job is put back
+// without using up an attempt.
+func (q *Queue) process(ctx context.Context, job *Job) {
+	unlock, ok := q.Handler.lockIdentity(job.Payload)
+	if !ok {
+		log.Printf("[INFO] Another operation for %s is in progress, postponing provisioning job %d.", job.Payload.Email, job.ID)
+		job.State = JobPending
+		job.NextAttempt = time.Now().Add(busyDelay)
+		if err := q.Store.Put(job); err != nil {
+			log.Printf("[ERROR] Saving provisioning job %d: %v", job.ID, err)
+		}
+		return
+	}
+	defer unlock()
+
+	job.Attempts++
+	log.Printf("[INFO] Running provisioning job %d (attempt %d/%d).", job.ID, job.Attempts, q.Config.MaxAttempts)
+
+	tx := newTxn()
+	err := q.Handler.provision(ctx, job.Payload, &job.Checkpoint, tx, func() {
+		if err := q.Store.Put(job); err != nil {
+			log.Printf("[WARNING] Saving checkpoint for job %d: %v", job.ID, err)
+		}
+	})
+	tx.res.Attempt = job.Attempts
+	tx.res.GitlabUserID = job.Checkpoint.GitlabUserID
+	tx.res.MattermostUserID = job.Checkpoint.MattermostUserID
+	tx.res.ChecklistURL = job.Checkpoint.ChecklistURL
+	job.History = append(job.History, tx.res)
+	if err != nil {
+		tx.fail(err)
+	}
+
+	switch {
+	case err == nil:
+		log.Printf("[INFO] Provisioning job %d done.", job.ID)
+		job.State = JobDone
+		job.LastError = ""
+		if err := q.Store.PutMember(&Member{
+			Email:            job.Payload.Email,
+			Payload:          job.Payload,
+			GitlabUserID:     job.Checkpoint.GitlabUserID,
+			MattermostUserID: job.Checkpoint.MattermostUserID,
+			JobID:            job.ID,
+			Expires:          q.accountExpiry(job, tx.plan),
+		}); err != nil {
+			log.Printf("[WARNING] Recording member %s: %v", job.Payload.Email, err)
+		}
+	case tx.res.Conflict != nil || isPermanent(err) || job.Attempts >= q.Config.MaxAttempts:
+		// Conflicts and unusable payloads will not go away by themselves,
+		// there is no point in retrying them.
+		log.Printf("[ERROR] Provisioning job %d failed permanently: %v", job.ID, err)
+		job.State = JobDead
+		job.LastError = err.Error()
+		if !q.Handler.Config.KeepOnFailure {
+			tx.rollback()
+			if len(tx.res.RollbackErrors) == 0 {
+				job.Checkpoint = Checkpoint{}
+			}
+		}
+	default:
+		delay := q.backoff(job.Attempts)
+		log.Printf("[WARNING] Provisioning job %d failed, retrying in %v: %v", job.ID, delay, err)
+		job.State = JobPending
+		job.LastError = err.Error()
+		job.NextAttempt = time.Now().Add(delay)
+	}
+
+	if job.State != JobPending && q.Handler.Config.Announce.Channel != "" {
+		data := q.Handler.announceData(job, tx.plan, tx.res)
+		if err := tx.do("mattermost: announce", func() (func() error, error) {
+			return nil, q.Handler.announce(data)
+		}); err != nil {
+			log.Printf("[WARNING] Announcing provisioning job %d: %v", job.ID, err)
+		}
+	}
+
+	tx.res.Finished = time.Now()
+	if err := q.Store.Put(job); err != nil {
+		log.Printf("[ERROR] Saving provisioning job %d: %v", job.ID, err)
+	}
+}
+
+// accountExpiry returns the expiry date of the member's Gitlab account. Only
+// accounts the job created get the planned one; reused accounts keep what
+// was recorded when Janus created them, if anything.
+func (q *Queue) accountExpiry(job *Job, p *Plan) string {
+	if job.Checkpoint.GitlabCreated {
+		if p == nil || p.Account == nil {
+			return ""
+		}
+		return p.Account.Expires
+	}
+	if m, err := q.Store.GetMember(job.Payload.Email); err == nil {
+		return m.Expires
+	}
+	return ""
+}
+
+// Retry schedules a job that gave up, or is waiting for its next attempt, to
+// run again right away. A job that gave up gets a fresh set of attempts.
+func (q *Queue) Retry(id uint64) (*Job, error) {
+	job, err := q.Store.retry(id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] Retrying provisioning job %d for %s.", job.ID, job.Payload.Email)
+	q.notify()
+	return job, nil
+}
+
+// backoff returns the delay before the next attempt, after the given number
+// of failed attempts.
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.Config.Backoff.Duration
+	for i := 1; i < attempts && delay < q.Config.MaxBackoff.Duration; i++ {
+		delay *= 2
+	}
+	if delay > q.Config.MaxBackoff.Duration {
+		delay = q.Config.MaxBackoff.Duration
+	}
+	return delay
+}
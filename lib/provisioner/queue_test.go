@@ -0,0 +1,359 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/xanzy/go-gitlab"
+)
+
+func openTestStore(t *testing.T) *Store {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "janus.db"))
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStoreClaim(t *testing.T) {
+	s := openTestStore(t)
+	now := time.Now()
+	jobs := []*Job{
+		{State: JobDone, NextAttempt: now.Add(-time.Hour)},
+		{State: JobPending, NextAttempt: now.Add(time.Hour)},
+		{State: JobAwaitingApproval, NextAttempt: now.Add(-time.Hour)},
+		{State: JobPending, NextAttempt: now.Add(-time.Minute)},
+		{State: JobRunning, NextAttempt: now.Add(-time.Hour)},
+		{State: JobPending, NextAttempt: now},
+	}
+	for _, job := range jobs {
+		job.Payload = &OnboardingUser{Email: "jane@example.com"}
+		if err := s.Add(job); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+
+	var got []uint64
+	for {
+		job, err := s.claim(now)
+		if err != nil {
+			t.Fatalf("claim failed: %v", err)
+		}
+		if job == nil {
+			break
+		}
+		if job.State != JobRunning {
+			t.Errorf("claimed job %d is %s, want running", job.ID, job.State)
+		}
+		if stored, err := s.Get(job.ID); err != nil || stored.State != JobRunning {
+			t.Errorf("stored job %d = %v, %v; want it running", job.ID, stored, err)
+		}
+		got = append(got, job.ID)
+	}
+	if diff := cmp.Diff([]uint64{jobs[3].ID, jobs[5].ID}, got); diff != "" {
+		t.Error("Unexpected claimed jobs (-want +got):\n", diff)
+	}
+}
+
+func TestStoreRequeueRunning(t *testing.T) {
+	s := openTestStore(t)
+	states := []JobState{JobRunning, JobDone, JobRunning, JobDead}
+	for _, state := range states {
+		if err := s.Add(&Job{State: state, Payload: &OnboardingUser{Email: "jane@example.com"}}); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if err := s.requeueRunning(); err != nil {
+		t.Fatalf("requeueRunning failed: %v", err)
+	}
+	jobs, err := s.List(nil)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	var got []JobState
+	for _, job := range jobs {
+		got = append(got, job.State)
+	}
+	// List returns the newest first.
+	want := []JobState{JobDead, JobPending, JobDone, JobPending}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("Unexpected job states (-want +got):\n", diff)
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := NewQueue(nil, nil, QueueConfig{
+		Backoff:    Duration{30 * time.Second},
+		MaxBackoff: Duration{5 * time.Minute},
+	})
+	for attempts, want := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		4:  4 * time.Minute,
+		5:  5 * time.Minute,
+		20: 5 * time.Minute,
+	} {
+		if got := q.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestQueueEnqueue(t *testing.T) {
+	h := &Handler{Config: &Config{}}
+	if err := h.Config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	s := openTestStore(t)
+	q := NewQueue(h, s, QueueConfig{})
+
+	first, err := q.Enqueue(&OnboardingUser{Name: "Jane", Email: "jane@example.com"})
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	job, err := q.Enqueue(&OnboardingUser{Name: "Jane Doe", Email: "Jane@example.com"})
+	if err != nil || job.ID != first.ID {
+		t.Fatalf("Enqueue of a duplicate: got %v, %v; want job %d", job, err, first.ID)
+	}
+	if stored, err := s.Get(first.ID); err != nil || stored.Payload.Name != "Jane Doe" {
+		t.Errorf("merged job: got %v, %v; want the latest payload", stored, err)
+	}
+	if _, err := q.Enqueue(&OnboardingUser{Email: "jane@example.org"}); !errors.Is(err, ErrBusy) {
+		t.Errorf("Enqueue of another email with the same username: got %v, want ErrBusy", err)
+	}
+
+	first.Checkpoint.Done = []string{"gitlab"}
+	if err := s.Put(first); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := q.Enqueue(&OnboardingUser{Email: "jane@example.com"}); !errors.Is(err, ErrBusy) {
+		t.Errorf("Enqueue for a started job: got %v, want ErrBusy", err)
+	}
+	if _, err := q.Run(context.Background(), &OnboardingUser{Email: "jane@example.com"}, "admin"); !errors.Is(err, ErrBusy) {
+		t.Errorf("Run for a user with an active job: got %v, want ErrBusy", err)
+	}
+}
+
+func TestQueueProcess(t *testing.T) {
+	m := &fakeMailer{}
+	h := &Handler{
+		Mailer: m,
+		Config: &Config{},
+		// The email of jim@example.com belongs to another Gitlab user.
+		Gitlab: fakeGitlabUsers(t, []*gitlab.User{{ID: 1, Email: "jim@example.com", Username: "james"}}),
+		// Usernames of users at example.org are taken, and checking
+		// those at example.net fails.
+		lookupUsername: func(username, email string) (bool, error) {
+			switch {
+			case strings.HasSuffix(email, "@example.org"):
+				return true, nil
+			case strings.HasSuffix(email, "@example.net"):
+				return false, errors.New("gitlab is down")
+			}
+			return false, nil
+		},
+	}
+	if err := h.Config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	s := openTestStore(t)
+	q := NewQueue(h, s, QueueConfig{MaxAttempts: 3, Backoff: Duration{time.Minute}})
+
+	for _, tc := range []struct {
+		desc         string
+		email        string
+		attempts     int // before this one.
+		checkpoint   Checkpoint
+		wantState    JobState
+		wantAttempts int
+		wantSkipped  []string // stages skipped as completed.
+		wantConflict bool
+	}{
+		{
+			desc:         "resumes from checkpoint",
+			email:        "jane@example.com",
+			attempts:     1,
+			checkpoint:   Checkpoint{Done: []string{"gitlab", "mattermost"}, GitlabUserID: 1, MattermostUserID: "u1"},
+			wantState:    JobDone,
+			wantAttempts: 2,
+			wantSkipped:  []string{"gitlab", "mattermost"},
+		},
+		{
+			desc:         "transient failure",
+			email:        "jane@example.net",
+			wantState:    JobPending,
+			wantAttempts: 1,
+		},
+		{
+			desc:         "out of attempts",
+			email:        "joe@example.net",
+			attempts:     2,
+			wantState:    JobDead,
+			wantAttempts: 3,
+		},
+		{
+			desc:         "conflict",
+			email:        "jim@example.com",
+			wantState:    JobDead,
+			wantAttempts: 1,
+			wantConflict: true,
+		},
+		{
+			desc:         "permanent failure",
+			email:        "jane@example.org",
+			wantState:    JobDead,
+			wantAttempts: 1,
+		},
+	} {
+		job := &Job{
+			State:      JobRunning,
+			Payload:    &OnboardingUser{Name: "Jane Doe", Email: tc.email},
+			Attempts:   tc.attempts,
+			Checkpoint: tc.checkpoint,
+		}
+		if err := s.Add(job); err != nil {
+			t.Fatalf("%s: Add failed: %v", tc.desc, err)
+		}
+		before := time.Now()
+		q.process(context.Background(), job)
+
+		got, err := s.Get(job.ID)
+		if err != nil {
+			t.Fatalf("%s: Get failed: %v", tc.desc, err)
+		}
+		if got.State != tc.wantState || got.Attempts != tc.wantAttempts {
+			t.Errorf("%s: job is %s after %d attempts, want %s after %d", tc.desc, got.State, got.Attempts, tc.wantState, tc.wantAttempts)
+		}
+		if len(got.History) != 1 {
+			t.Fatalf("%s: job has %d results, want 1", tc.desc, len(got.History))
+		}
+		res := got.Latest()
+		var skipped []string
+		for _, step := range res.Steps {
+			if step.Skipped == "completed by an earlier attempt" {
+				skipped = append(skipped, step.Name)
+			}
+		}
+		if diff := cmp.Diff(tc.wantSkipped, skipped); diff != "" {
+			t.Errorf("%s: unexpected skipped stages (-want +got):\n%s", tc.desc, diff)
+		}
+		if gotConflict := res.Conflict != nil; gotConflict != tc.wantConflict {
+			t.Errorf("%s: got conflict %+v, want conflict: %t", tc.desc, res.Conflict, tc.wantConflict)
+		}
+		switch tc.wantState {
+		case JobDone:
+			if got.LastError != "" || res.Error != "" {
+				t.Errorf("%s: done job has errors %q, %q", tc.desc, got.LastError, res.Error)
+			}
+			if _, err := s.GetMember(tc.email); err != nil {
+				t.Errorf("%s: GetMember failed: %v", tc.desc, err)
+			}
+		case JobPending:
+			if got.LastError == "" {
+				t.Errorf("%s: pending job has no error", tc.desc)
+			}
+			if got.NextAttempt.Before(before.Add(time.Minute)) {
+				t.Errorf("%s: next attempt at %v, want a minute from now", tc.desc, got.NextAttempt)
+			}
+		case JobDead:
+			if got.LastError == "" || res.Error == "" {
+				t.Errorf("%s: dead job has no error", tc.desc)
+			}
+		}
+	}
+	if len(m.sent) != 1 {
+		t.Errorf("sent %d emails, want 1", len(m.sent))
+	}
+}
+
+func TestQueueProcessPlanFailureRollsBack(t *testing.T) {
+	deleted := map[string]bool{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/users/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodDelete {
+			deleted[strings.TrimPrefix(req.URL.Path, "/api/v4/users/")] = true
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client, err := gitlab.NewClient("token", gitlab.WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("creating gitlab client: %v", err)
+	}
+	h := &Handler{
+		Gitlab: client,
+		Config: &Config{},
+		lookupUsername: func(username, email string) (bool, error) {
+			return false, errors.New("gitlab is down")
+		},
+	}
+	if err := h.Config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	s := openTestStore(t)
+	q := NewQueue(h, s, QueueConfig{MaxAttempts: 2, Backoff: Duration{time.Minute}})
+
+	// The first attempt created the Gitlab account, and planning the last
+	// one fails.
+	job := &Job{
+		State:      JobRunning,
+		Payload:    &OnboardingUser{Name: "Jane Doe", Email: "jane@example.com"},
+		Attempts:   1,
+		Checkpoint: Checkpoint{Done: []string{"gitlab"}, GitlabUserID: 5, GitlabCreated: true},
+	}
+	if err := s.Add(job); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	q.process(context.Background(), job)
+
+	got, err := s.Get(job.ID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if got.State != JobDead {
+		t.Errorf("job is %s, want dead", got.State)
+	}
+	if !deleted["5"] {
+		t.Error("the Gitlab user created by the first attempt was not deleted")
+	}
+	if diff := cmp.Diff([]string{"gitlab: delete user created by an earlier attempt"}, got.Latest().RolledBack); diff != "" {
+		t.Error("Unexpected rolled back steps (-want +got):\n", diff)
+	}
+	if got.Checkpoint.GitlabUserID != 0 {
+		t.Errorf("checkpoint still has Gitlab user %d after the rollback", got.Checkpoint.GitlabUserID)
+	}
+}
+
+func TestQueueAccountExpiry(t *testing.T) {
+	s := openTestStore(t)
+	q := NewQueue(nil, s, QueueConfig{})
+	if err := s.PutMember(&Member{Email: "joe@example.com", Expires: "2030-01-31"}); err != nil {
+		t.Fatalf("PutMember failed: %v", err)
+	}
+	p := &Plan{Account: &AccountProfile{Expires: "2031-06-30"}}
+	for _, tc := range []struct {
+		name    string
+		email   string
+		created bool
+		want    string
+	}{
+		{name: "created", email: "jane@example.com", created: true, want: "2031-06-30"},
+		{name: "reused", email: "jane@example.com"},
+		{name: "reused member", email: "joe@example.com", want: "2030-01-31"},
+	} {
+		job := &Job{Payload: &OnboardingUser{Email: tc.email}, Checkpoint: Checkpoint{GitlabCreated: tc.created}}
+		if got := q.accountExpiry(job, p); got != tc.want {
+			t.Errorf("%s: accountExpiry() = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mattermost "github.com/mattermost/mattermost-server/v6/model"
+	"github.com/xanzy/go-gitlab"
+	"gitlab.operationuplift.work/operations/development/janus/lib/actionlog"
+)
+
+// ReconcileConfig configures the periodic reconciliation of Mattermost
+// memberships.
+type ReconcileConfig struct {
+	// Interval between runs. If unset, reconciliation only runs when
+	// started from the admin page.
+	Interval Duration
+}
+
+// ReconcileReport is the outcome of a reconciliation run.
+type ReconcileReport struct {
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Members  int            `json:"members"` // members checked.
+	Missing  int            `json:"missing"` // memberships rules grant that members lack.
+	Extra    int            `json:"extra"`   // managed memberships no rule grants.
+	Fixed    int            `json:"fixed"`   // missing memberships restored.
+	Expired  int            `json:"expired"` // Gitlab accounts blocked as expired.
+	Log      *actionlog.Log `json:"log"`     // members with differences or errors.
+}
+
+// Reconciler periodically compares the Mattermost teams and channels of
+// provisioned members with what the rules grant them. Differences are
+// reported; missing memberships granted by rules with AutoFix are restored.
+// Members whose accounts are deactivated or blocked are skipped. Gitlab
+// accounts past their expiry are blocked.
+type Reconciler struct {
+	Handler *Handler
+	Store   *Store
+
+	mu sync.Mutex // one run at a time.
+}
+
+// Run reconciles periodically until ctx is done.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.Reconcile(); err != nil {
+				log.Printf("[ERROR] Reconciling memberships: %v", err)
+			}
+		}
+	}
+}
+
+// Reconcile checks every provisioned member, stores the report and returns
+// it.
+func (r *Reconciler) Reconcile() (*ReconcileReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rep := &ReconcileReport{
+		Started: time.Now(),
+		Log:     &actionlog.Log{Title: "Reconciling memberships"},
+	}
+	members, err := r.Store.Members()
+	if err != nil {
+		return nil, fmt.Errorf("listing members: %w", err)
+	}
+	h := r.Handler
+	managed, err := h.teamGrants(h.Config.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("resolving teams and channels: %w", err)
+	}
+	sticky, err := h.stickyMemberships()
+	if err != nil {
+		return nil, fmt.Errorf("resolving sticky memberships: %w", err)
+	}
+
+	for _, m := range members {
+		rep.Members++
+		le := &actionlog.Entity{Name: fmt.Sprintf("user %s", m.Email)}
+		r.reconcileMember(m, managed, sticky, rep, le)
+		if len(le.Log) > 0 {
+			rep.Log.Entities = append(rep.Log.Entities, le)
+		}
+	}
+	rep.Finished = time.Now()
+	log.Printf("[INFO] Reconciled %d members: %d missing memberships (%d fixed), %d extra, %d expired.", rep.Members, rep.Missing, rep.Fixed, rep.Extra, rep.Expired)
+
+	if err := r.Store.AddReport(rep); err != nil {
+		return rep, fmt.Errorf("storing report: %w", err)
+	}
+	return rep, nil
+}
+
+// expire blocks the Gitlab account of a member past its expiry date, after
+// revoking its tokens. Mattermost accounts signing in through Gitlab lose
+// access with it. It reports whether the member has expired, in which case
+// there is nothing left to reconcile.
+func (r *Reconciler) expire(m *Member, rep *ReconcileReport, le *actionlog.Entity) bool {
+	if m.Expires == "" || m.GitlabUserID == 0 || time.Now().Format(dateFormat) < m.Expires {
+		return false
+	}
+	h := r.Handler
+	user, _, err := h.Gitlab.Users.GetUser(m.GitlabUserID, gitlab.GetUsersOptions{})
+	if err != nil {
+		le.Errorf("getting gitlab user %d: %v", m.GitlabUserID, err)
+		return true
+	}
+	if user.State == "blocked" {
+		le.Logf("skipped, gitlab account %s expired on %s", user.Username, m.Expires)
+		return true
+	}
+	h.revokeGitlabTokens(user.ID, le)
+	if err := h.Gitlab.Users.BlockUser(user.ID); err != nil {
+		le.Errorf("blocking expired gitlab account %s: %v", user.Username, err)
+		return true
+	}
+	rep.Expired++
+	le.Logf("gitlab account %s expired on %s and is now blocked", user.Username, m.Expires)
+	return true
+}
+
+func (r *Reconciler) reconcileMember(m *Member, managed []TeamGrant, sticky memberships, rep *ReconcileReport, le *actionlog.Entity) {
+	h := r.Handler
+	// An offboarding or update running at the same time would race with
+	// the fixes; the member is checked again on the next run.
+	unlock, ok := h.lockIdentity(m.Payload)
+	if !ok {
+		le.Logf("skipped, another operation for this user is in progress")
+		return
+	}
+	defer unlock()
+
+	if r.expire(m, rep, le) {
+		return
+	}
+	user, err := r.mattermostUser(m)
+	if err != nil {
+		le.Errorf("getting mattermost user: %v", err)
+		return
+	}
+	if user.DeleteAt != 0 {
+		le.Logf("skipped, mattermost account %s is deactivated", user.Username)
+		return
+	}
+	if m.GitlabUserID != 0 {
+		gu, _, err := h.Gitlab.Users.GetUser(m.GitlabUserID, gitlab.GetUsersOptions{})
+		if err != nil {
+			le.Errorf("getting gitlab user %d: %v", m.GitlabUserID, err)
+			return
+		}
+		if gu.State != "active" {
+			le.Logf("skipped, gitlab account %s is %s", gu.Username, gu.State)
+			return
+		}
+	}
+	userID := user.Id
+
+	// Only Mattermost memberships are reconciled, so only they are planned.
+	rules := h.Config.MatchingRules(m.Payload)
+	teams, err := h.teamGrants(rules)
+	if err != nil {
+		le.Errorf("resolving granted teams and channels: %v", err)
+		return
+	}
+
+	current := memberships{}
+	for _, tg := range managed {
+		ok, err := h.isTeamMember(tg.TeamID, userID)
+		if err != nil {
+			le.Errorf("checking team %q membership: %v", tg.Team, err)
+			return
+		}
+		current[teamKey(tg.TeamID)] = ok
+		for _, cg := range tg.Channels {
+			if !ok {
+				break
+			}
+			isMember, err := h.isChannelMember(cg.ID, userID)
+			if err != nil {
+				le.Errorf("checking channel %q membership: %v", cg.Channel, err)
+				return
+			}
+			current[channelKey(cg.ID)] = isMember
+		}
+	}
+
+	diff := diffMemberships(&Plan{Teams: teams}, nil, managed, current, sticky, true)
+	fix, err := h.autoFixMemberships(rules)
+	if err != nil {
+		le.Errorf("resolving auto-fixed memberships: %v", err)
+		return
+	}
+
+	for _, tg := range diff.AddTeams {
+		rep.Missing++
+		if !fix[teamKey(tg.TeamID)] {
+			le.Errorf("not in team %q", tg.Team)
+			continue
+		}
+		if _, _, err := h.Mattermost.AddTeamMember(tg.TeamID, userID); err != nil {
+			le.Errorf("not in team %q, adding failed: %v", tg.Team, err)
+			continue
+		}
+		rep.Fixed++
+		le.Logf("was not in team %q, added back", tg.Team)
+	}
+	for _, cg := range diff.AddChannels {
+		rep.Missing++
+		if !fix[channelKey(cg.ID)] {
+			le.Errorf("not in channel %q", cg.Channel)
+			continue
+		}
+		if _, _, err := h.Mattermost.AddChannelMember(cg.ID, userID); err != nil {
+			le.Errorf("not in channel %q, adding failed: %v", cg.Channel, err)
+			continue
+		}
+		rep.Fixed++
+		le.Logf("was not in channel %q, added back", cg.Channel)
+	}
+	for _, tg := range diff.RemoveTeams {
+		rep.Extra++
+		le.Logf("in team %q, which no rule grants", tg.Team)
+	}
+	for _, cg := range diff.RemoveChannels {
+		rep.Extra++
+		le.Logf("in channel %q, which no rule grants", cg.Channel)
+	}
+}
+
+// mattermostUser returns the member's Mattermost account.
+func (r *Reconciler) mattermostUser(m *Member) (*mattermost.User, error) {
+	if m.MattermostUserID != "" {
+		user, _, err := r.Handler.Mattermost.GetUser(m.MattermostUserID, "")
+		return user, err
+	}
+	user, _, err := r.Handler.Mattermost.GetUserByEmail(m.Email, "")
+	return user, err
+}
+
+// autoFixMemberships returns the teams and channels granted by the given
+// matching rules that have AutoFix.
+func (h *Handler) autoFixMemberships(rules []Rule) (memberships, error) {
+	res := memberships{}
+	for _, rule := range rules {
+		if !rule.AutoFix || rule.Team == "" {
+			continue
+		}
+		teamID, err := h.Names.Team(rule.Team)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		res[teamKey(teamID)] = true
+		for _, channel := range rule.Channels {
+			id, err := h.Names.Channel(teamID, channel)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+			}
+			res[channelKey(id)] = true
+		}
+	}
+	return res, nil
+}
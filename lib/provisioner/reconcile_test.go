@@ -0,0 +1,68 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+	"gitlab.operationuplift.work/operations/development/janus/lib/actionlog"
+)
+
+func TestReconcilerExpire(t *testing.T) {
+	state := "active"
+	blocked := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/users/7", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(&gitlab.User{ID: 7, Username: "jane", State: state})
+	})
+	mux.HandleFunc("/api/v4/users/7/impersonation_tokens", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode([]*gitlab.ImpersonationToken{})
+	})
+	mux.HandleFunc("/api/v4/personal_access_tokens", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode([]*gitlab.PersonalAccessToken{})
+	})
+	mux.HandleFunc("/api/v4/users/7/block", func(w http.ResponseWriter, req *http.Request) {
+		blocked++
+		state = "blocked"
+		w.WriteHeader(http.StatusCreated)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client, err := gitlab.NewClient("token", gitlab.WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("creating gitlab client: %v", err)
+	}
+	r := &Reconciler{Handler: &Handler{Gitlab: client}}
+
+	today := time.Now().Format(dateFormat)
+	tomorrow := time.Now().AddDate(0, 0, 1).Format(dateFormat)
+	for _, tc := range []struct {
+		name        string
+		expires     string
+		wantExpired bool
+		wantBlocked int // blocks so far.
+	}{
+		{name: "no expiry"},
+		{name: "not yet", expires: tomorrow},
+		{name: "expired", expires: today, wantExpired: true, wantBlocked: 1},
+		{name: "already blocked", expires: today, wantExpired: true, wantBlocked: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rep := &ReconcileReport{}
+			le := &actionlog.Entity{Name: "user jane@example.com"}
+			m := &Member{Email: "jane@example.com", GitlabUserID: 7, Expires: tc.expires}
+			if got := r.expire(m, rep, le); got != tc.wantExpired {
+				t.Errorf("expire() = %t, want %t", got, tc.wantExpired)
+			}
+			if le.HasErrors {
+				t.Errorf("expire had errors: %+v", le.Log)
+			}
+			if blocked != tc.wantBlocked {
+				t.Errorf("blocked %d times, want %d", blocked, tc.wantBlocked)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// ruleMatcher is the compiled form of a rule's matching conditions.
+type ruleMatcher struct {
+	any, all, not []*regexp.Regexp
+	domains       []string
+}
+
+// Validate checks the configuration and prepares the rules for matching.
+// It must be called before the configuration is used.
+func (c *Config) Validate() error {
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("rule #%d (%q): %w", i+1, r.Name, err)
+		}
+	}
+	if err := c.validateIntake(); err != nil {
+		return err
+	}
+	if err := c.Usernames.validate(); err != nil {
+		return fmt.Errorf("usernames: %w", err)
+	}
+	if err := c.Account.validate(); err != nil {
+		return fmt.Errorf("account: %w", err)
+	}
+	if c.expiresAccounts() && c.Reconcile.Interval.Duration <= 0 {
+		return errors.New("account: expires requires reconcile.interval, as reconciliation blocks expired accounts")
+	}
+	if err := c.Announce.compile(); err != nil {
+		return fmt.Errorf("announce: %w", err)
+	}
+	if err := c.Checklist.compile(); err != nil {
+		return fmt.Errorf("checklist: %w", err)
+	}
+	if c.WelcomeMessage != "" {
+		tmpl, err := compileWelcomeMessage(c.WelcomeMessage)
+		if err != nil {
+			return fmt.Errorf("welcomeMessage: %w", err)
+		}
+		c.welcomeMsg = tmpl
+	}
+	return c.compileWelcomeVariables()
+}
+
+func (r *Rule) compile() error {
+	if r.Skill != "" && len(r.AnySkills) > 0 {
+		return errors.New("skill and anySkills are mutually exclusive")
+	}
+	if r.Skill == "" && len(r.AnySkills) == 0 && len(r.AllSkills) == 0 && len(r.EmailDomains) == 0 {
+		return errors.New("one of skill, anySkills, allSkills or emailDomains is required")
+	}
+	if len(r.Channels) > 0 && r.Team == "" {
+		return errors.New("channels require a team")
+	}
+	if r.WelcomeMessage != "" {
+		tmpl, err := compileWelcomeMessage(r.WelcomeMessage)
+		if err != nil {
+			return fmt.Errorf("welcomeMessage: %w", err)
+		}
+		r.welcomeMsg = tmpl
+	}
+	if r.Account != nil {
+		if err := r.Account.validate(); err != nil {
+			return fmt.Errorf("account: %w", err)
+		}
+	}
+	for j := range r.Gitlab {
+		g := &r.Gitlab[j]
+		if err := g.validate(); err != nil {
+			return fmt.Errorf("gitlab[%d]: %w", j, err)
+		}
+		if g.Access == 0 {
+			g.Access = AccessLevel(gitlab.DeveloperPermissions)
+		}
+	}
+
+	m := &ruleMatcher{}
+	var err error
+	anySkills := r.AnySkills
+	if r.Skill != "" {
+		anySkills = []string{r.Skill}
+	}
+	if m.any, err = r.patterns("anySkills", anySkills); err != nil {
+		return err
+	}
+	if m.all, err = r.patterns("allSkills", r.AllSkills); err != nil {
+		return err
+	}
+	if m.not, err = r.patterns("notSkills", r.NotSkills); err != nil {
+		return err
+	}
+	for j, d := range r.EmailDomains {
+		d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@"))
+		if d == "" || strings.ContainsAny(d, "@ ") {
+			return fmt.Errorf("emailDomains[%d]: invalid domain %q", j, r.EmailDomains[j])
+		}
+		m.domains = append(m.domains, d)
+	}
+	r.matcher = m
+	return nil
+}
+
+// patterns compiles skill patterns. Literal skills are matched exactly,
+// regular expressions must match the whole skill.
+func (r *Rule) patterns(field string, skills []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for j, skill := range skills {
+		expr := skill
+		if !r.Regex {
+			expr = regexp.QuoteMeta(strings.TrimSpace(skill))
+		}
+		expr = "^(?:" + expr + ")$"
+		if r.IgnoreCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: invalid pattern %q: %w", field, j, skill, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// matches reports whether the rule applies to the user.
+func (r *Rule) matches(u *OnboardingUser) bool {
+	m := r.matcher
+	if m == nil {
+		panic("provisioner: rule used before Config.Validate")
+	}
+	skills := u.Skills()
+	if len(m.any) > 0 && !anyMatch(m.any, skills) {
+		return false
+	}
+	for _, re := range m.all {
+		if !anyMatch([]*regexp.Regexp{re}, skills) {
+			return false
+		}
+	}
+	if anyMatch(m.not, skills) {
+		return false
+	}
+	if len(m.domains) > 0 && !has(m.domains, emailDomain(u.Email)) {
+		return false
+	}
+	return true
+}
+
+// MatchingRules returns the rules that apply to the user, in decreasing
+// order of priority. Rules with the same priority keep their config order.
+// A matching rule with Stop set ends the evaluation.
+func (c *Config) MatchingRules(u *OnboardingUser) []Rule {
+	rules := make([]Rule, len(c.Rules))
+	copy(rules, c.Rules)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority > rules[j].Priority
+	})
+
+	var res []Rule
+	for _, r := range rules {
+		if !r.matches(u) {
+			continue
+		}
+		res = append(res, r)
+		if r.Stop {
+			break
+		}
+	}
+	return res
+}
+
+func anyMatch(patterns []*regexp.Regexp, skills []string) bool {
+	for _, re := range patterns {
+		for _, s := range skills {
+			if re.MatchString(s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func emailDomain(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(email[i+1:])
+}
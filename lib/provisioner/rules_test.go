@@ -0,0 +1,47 @@
+package provisioner
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMatchingRules(t *testing.T) {
+	cfg := &Config{Rules: []Rule{
+		{Name: "exact", Skill: "Programming"},
+		{Name: "any of", AnySkills: []string{"Design", "Data analysis"}},
+		{Name: "all of", AllSkills: []string{"Programming", "Design"}},
+		{Name: "programming not design", Skill: "Programming", NotSkills: []string{"Design"}},
+		{Name: "case insensitive", Skill: "programming", IgnoreCase: true},
+		{Name: "regex", AnySkills: []string{"data .*"}, Regex: true, IgnoreCase: true},
+		{Name: "domain", EmailDomains: []string{"@Example.org"}},
+		{Name: "high priority", Skill: "Urgent", Priority: 10},
+		{Name: "stopper", Skill: "Stop", Priority: 5, Stop: true},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		email, skills string
+		want          []string
+	}{
+		{"a@example.com", "Programming", []string{"exact", "programming not design", "case insensitive"}},
+		{"a@example.com", "Programming, Design", []string{"exact", "any of", "all of", "case insensitive"}},
+		{"a@example.com", "PROGRAMMING", []string{"case insensitive"}},
+		{"a@example.com", "Data Analysis", []string{"regex"}},
+		{"a@example.org", "Cooking", []string{"domain"}},
+		{"a@sub.example.org", "Cooking", nil},
+		{"a@example.com", "Programming,Urgent", []string{"high priority", "exact", "programming not design", "case insensitive"}},
+		{"a@example.com", "Urgent,Stop,Programming", []string{"high priority", "stopper"}},
+	} {
+		got := cfg.MatchingRules(&OnboardingUser{Email: tc.email, RawSkills: tc.skills})
+		var names []string
+		for _, r := range got {
+			names = append(names, r.Name)
+		}
+		if diff := cmp.Diff(tc.want, names); diff != "" {
+			t.Errorf("MatchingRules(%q, %q) diff (-want +got):\n%s", tc.email, tc.skills, diff)
+		}
+	}
+}
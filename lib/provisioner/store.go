@@ -0,0 +1,531 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	jobsBucket    = []byte("jobs")
+	membersBucket = []byte("members")
+	reportsBucket = []byte("reconcile")
+	activeBucket  = []byte("active") // identity keys of active jobs to job IDs.
+)
+
+// maxReports is how many reconciliation reports are kept.
+const maxReports = 20
+
+var (
+	// ErrNotFound is returned when a job does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrNotRetryable is returned when retrying a job that is running, done,
+	// or has not failed yet.
+	ErrNotRetryable = errors.New("not retryable")
+	// ErrNotAwaitingApproval is returned when reviewing a job that does not
+	// need approval, or was already reviewed.
+	ErrNotAwaitingApproval = errors.New("not awaiting approval")
+	// ErrBusy is returned when adding a job for a user who already has an
+	// active job that the new one cannot be merged into.
+	ErrBusy = errors.New("another job for this user is in progress")
+)
+
+// JobState is the lifecycle state of a provisioning job.
+type JobState string
+
+const (
+	JobAwaitingApproval JobState = "awaiting-approval" // waiting to be reviewed.
+	JobRejected         JobState = "rejected"          // rejected on review, never ran.
+	JobPending          JobState = "pending"           // waiting for its first or next attempt.
+	JobRunning          JobState = "running"           // picked up by a worker.
+	JobDone             JobState = "done"              // provisioned successfully.
+	JobDead             JobState = "dead"              // gave up, needs a human.
+)
+
+// Job is a single onboarding request and its progress.
+type Job struct {
+	ID          uint64          `json:"id"`
+	State       JobState        `json:"state"`
+	Payload     *OnboardingUser `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastError   string          `json:"lastError,omitempty"`
+	Checkpoint  Checkpoint      `json:"checkpoint"`
+	History     []*Result       `json:"history,omitempty"` // every attempt, oldest first.
+	Review      *Review         `json:"review,omitempty"`  // set once the job was approved or rejected.
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+// Review records who approved or rejected a job, and why.
+type Review struct {
+	By       string    `json:"by"`
+	At       time.Time `json:"at"`
+	Approved bool      `json:"approved"`
+	Reason   string    `json:"reason,omitempty"`
+	Notified bool      `json:"notified,omitempty"` // the applicant was emailed about the rejection.
+}
+
+// Checkpoint records how far a job got, so that a retry resumes at the
+// stage that failed.
+type Checkpoint struct {
+	Done              []string `json:"done,omitempty"` // completed pipeline stages.
+	GitlabUserID      int      `json:"gitlabUserID,omitempty"`
+	GitlabCreated     bool     `json:"gitlabCreated,omitempty"` // account was created by this job.
+	MattermostUserID  string   `json:"mattermostUserID,omitempty"`
+	MattermostCreated bool     `json:"mattermostCreated,omitempty"`
+	ChecklistURL      string   `json:"checklistURL,omitempty"`
+}
+
+// Latest returns the outcome of the latest attempt, or nil if the job has
+// not run yet.
+func (j *Job) Latest() *Result {
+	if len(j.History) == 0 {
+		return nil
+	}
+	return j.History[len(j.History)-1]
+}
+
+// active reports whether the job has yet to finish.
+func (j *Job) active() bool {
+	switch j.State {
+	case JobAwaitingApproval, JobPending, JobRunning:
+		return true
+	}
+	return false
+}
+
+// started reports whether an attempt of the job got anywhere.
+func (j *Job) started() bool {
+	cp := &j.Checkpoint
+	return len(cp.Done) > 0 || cp.GitlabUserID != 0 || cp.MattermostUserID != ""
+}
+
+// Retryable reports whether the job can be retried by hand: it gave up, or
+// it is waiting to retry a failed attempt.
+func (j *Job) Retryable() bool {
+	return j.State == JobDead || (j.State == JobPending && j.LastError != "")
+}
+
+func (cp *Checkpoint) done(stage string) bool {
+	return has(cp.Done, stage)
+}
+
+// Member is a user provisioned by Janus, with the payload their memberships
+// derive from.
+type Member struct {
+	Email            string          `json:"email"`
+	Payload          *OnboardingUser `json:"payload"`
+	GitlabUserID     int             `json:"gitlabUserID,omitempty"`
+	MattermostUserID string          `json:"mattermostUserID,omitempty"`
+	JobID            uint64          `json:"jobID,omitempty"`   // job that provisioned them.
+	Expires          string          `json:"expires,omitempty"` // Gitlab account expiry date, if Janus created it with one.
+	UpdatedAt        time.Time       `json:"updatedAt"`
+}
+
+// Store persists provisioning jobs, provisioned members and reconciliation
+// reports in a local bbolt database.
+type Store struct {
+	db *bolt.DB
+}
+
+// OpenStore opens (creating if needed) the job database in the given file.
+func OpenStore(file string) (*Store, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{jobsBucket, membersBucket, reportsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return reindexActive(tx)
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Add stores a new job, assigning it an ID.
+func (s *Store) Add(job *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		job.ID = id
+		job.CreatedAt = time.Now()
+		return putJob(tx, job)
+	})
+}
+
+// addUnlessActive stores a new job like Add, unless a job for the same
+// email or username is awaiting approval, pending or running. In that case,
+// merge is called on that job instead: if it succeeds, the job it changed is
+// stored and returned. Otherwise, nothing is stored and its error returned
+// along with the job. If the email and the username belong to two different
+// active jobs, it fails with ErrBusy.
+func (s *Store) addUnlessActive(job *Job, merge func(existing *Job) error) (*Job, error) {
+	var existing *Job
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		idx := tx.Bucket(activeBucket)
+		for _, key := range identityKeys(job.Payload) {
+			id := idx.Get([]byte(key))
+			if id == nil || existing != nil && bytes.Equal(id, jobKey(existing.ID)) {
+				continue
+			}
+			other := &Job{}
+			if err := json.Unmarshal(b.Get(id), other); err != nil {
+				return fmt.Errorf("decoding job %x: %w", id, err)
+			}
+			if existing != nil {
+				return busyError(other)
+			}
+			existing = other
+		}
+		if existing != nil {
+			if err := merge(existing); err != nil {
+				return err
+			}
+			return putJob(tx, existing)
+		}
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		job.ID = id
+		job.CreatedAt = time.Now()
+		return putJob(tx, job)
+	})
+	return existing, err
+}
+
+// Put updates an existing job.
+func (s *Store) Put(job *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putJob(tx, job)
+	})
+}
+
+// Get returns the job with the given ID, or ErrNotFound.
+func (s *Store) Get(id uint64) (*Job, error) {
+	var job *Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(jobsBucket).Get(jobKey(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		job = &Job{}
+		return json.Unmarshal(data, job)
+	})
+	return job, err
+}
+
+// List returns all jobs for which keep returns true, newest first. A nil
+// keep function returns all jobs.
+func (s *Store) List(keep func(*Job) bool) ([]*Job, error) {
+	var res []*Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(jobsBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			job := &Job{}
+			if err := json.Unmarshal(v, job); err != nil {
+				return fmt.Errorf("decoding job %x: %w", k, err)
+			}
+			if keep == nil || keep(job) {
+				res = append(res, job)
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// claim marks the oldest pending job that is due as running and returns it.
+// It returns nil if there is nothing to do.
+func (s *Store) claim(now time.Time) (*Job, error) {
+	var res *Job
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			job := &Job{}
+			if err := json.Unmarshal(v, job); err != nil {
+				return fmt.Errorf("decoding job %x: %w", k, err)
+			}
+			if job.State != JobPending || job.NextAttempt.After(now) {
+				continue
+			}
+			job.State = JobRunning
+			res = job
+			return putJob(tx, job)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// retry makes a retryable job due at now, giving a job that gave up a fresh
+// set of attempts.
+func (s *Store) retry(id uint64, now time.Time) (*Job, error) {
+	return s.update(id, func(job *Job) error {
+		if !job.Retryable() {
+			return fmt.Errorf("job %d is %s: %w", id, job.State, ErrNotRetryable)
+		}
+		if job.State == JobDead {
+			job.Attempts = 0
+		}
+		job.State = JobPending
+		job.NextAttempt = now
+		return nil
+	})
+}
+
+// update applies fn to the job with the given ID and stores the result, in
+// a single transaction. If fn fails, the job is left as is.
+func (s *Store) update(id uint64, fn func(*Job) error) (*Job, error) {
+	var job *Job
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		data := b.Get(jobKey(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		job = &Job{}
+		if err := json.Unmarshal(data, job); err != nil {
+			return fmt.Errorf("decoding job %d: %w", id, err)
+		}
+		if err := fn(job); err != nil {
+			return err
+		}
+		return putJob(tx, job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// requeueRunning puts back jobs that were running when the server stopped.
+func (s *Store) requeueRunning() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		var running []*Job
+		if err := b.ForEach(func(k, v []byte) error {
+			job := &Job{}
+			if err := json.Unmarshal(v, job); err != nil {
+				return fmt.Errorf("decoding job %x: %w", k, err)
+			}
+			if job.State == JobRunning {
+				running = append(running, job)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, job := range running {
+			job.State = JobPending
+			if err := putJob(tx, job); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PutMember adds or updates a provisioned member.
+func (s *Store) PutMember(m *Member) error {
+	m.UpdatedAt = time.Now()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(membersBucket).Put(memberKey(m.Email), data)
+	})
+}
+
+// GetMember returns the member with the given email, or ErrNotFound.
+func (s *Store) GetMember(email string) (*Member, error) {
+	var m *Member
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(membersBucket).Get(memberKey(email))
+		if data == nil {
+			return ErrNotFound
+		}
+		m = &Member{}
+		return json.Unmarshal(data, m)
+	})
+	return m, err
+}
+
+// DeleteMember forgets a member. Deleting a missing member is not an error.
+func (s *Store) DeleteMember(email string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(membersBucket).Delete(memberKey(email))
+	})
+}
+
+// Members returns all provisioned members, ordered by email.
+func (s *Store) Members() ([]*Member, error) {
+	var res []*Member
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(membersBucket).ForEach(func(k, v []byte) error {
+			m := &Member{}
+			if err := json.Unmarshal(v, m); err != nil {
+				return fmt.Errorf("decoding member %s: %w", k, err)
+			}
+			res = append(res, m)
+			return nil
+		})
+	})
+	return res, err
+}
+
+// AddReport stores a reconciliation report, dropping the oldest ones beyond
+// maxReports.
+func (s *Store) AddReport(r *ReconcileReport) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(reportsBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(jobKey(id), data); err != nil {
+			return err
+		}
+		var old [][]byte
+		c := b.Cursor()
+		n := 0
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			if n++; n > maxReports {
+				old = append(old, k)
+			}
+		}
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Reports returns the stored reconciliation reports, newest first.
+func (s *Store) Reports() ([]*ReconcileReport, error) {
+	var res []*ReconcileReport
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(reportsBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			r := &ReconcileReport{}
+			if err := json.Unmarshal(v, r); err != nil {
+				return fmt.Errorf("decoding report %x: %w", k, err)
+			}
+			res = append(res, r)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// putJob stores a job and keeps the index of active jobs up to date.
+func putJob(tx *bolt.Tx, job *Job) error {
+	b := tx.Bucket(jobsBucket)
+	if data := b.Get(jobKey(job.ID)); data != nil {
+		old := &Job{}
+		if err := json.Unmarshal(data, old); err != nil {
+			return fmt.Errorf("decoding job %d: %w", job.ID, err)
+		}
+		if err := unindexJob(tx, old); err != nil {
+			return err
+		}
+	}
+	job.UpdatedAt = time.Now()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(jobKey(job.ID), data); err != nil {
+		return err
+	}
+	return indexJob(tx, job)
+}
+
+// indexJob adds an active job to the index, by the identity keys of its
+// user.
+func indexJob(tx *bolt.Tx, job *Job) error {
+	if !job.active() || job.Payload == nil {
+		return nil
+	}
+	idx := tx.Bucket(activeBucket)
+	for _, key := range identityKeys(job.Payload) {
+		if err := idx.Put([]byte(key), jobKey(job.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexJob removes a job from the index.
+func unindexJob(tx *bolt.Tx, job *Job) error {
+	if job.Payload == nil {
+		return nil
+	}
+	idx := tx.Bucket(activeBucket)
+	for _, key := range identityKeys(job.Payload) {
+		if bytes.Equal(idx.Get([]byte(key)), jobKey(job.ID)) {
+			if err := idx.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reindexActive builds the index of active jobs, for databases written
+// before there was one.
+func reindexActive(tx *bolt.Tx) error {
+	if tx.Bucket(activeBucket) != nil {
+		return nil
+	}
+	if _, err := tx.CreateBucket(activeBucket); err != nil {
+		return err
+	}
+	return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+		job := &Job{}
+		if err := json.Unmarshal(v, job); err != nil {
+			return fmt.Errorf("decoding job %x: %w", k, err)
+		}
+		return indexJob(tx, job)
+	})
+}
+
+func memberKey(email string) []byte {
+	return []byte(strings.ToLower(strings.TrimSpace(email)))
+}
+
+func jobKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
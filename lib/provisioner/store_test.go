@@ -0,0 +1,156 @@
+package provisioner
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreMembersAndReports(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "janus.db"))
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	defer s.Close()
+
+	for _, email := range []string{"joe@example.com", "Jane@example.com"} {
+		if err := s.PutMember(&Member{Email: email, Payload: &OnboardingUser{Email: email}}); err != nil {
+			t.Fatalf("PutMember(%s) failed: %v", email, err)
+		}
+	}
+	if m, err := s.GetMember("jane@EXAMPLE.com"); err != nil || m.Email != "Jane@example.com" {
+		t.Errorf("GetMember = %v, %v; want Jane@example.com", m, err)
+	}
+	if err := s.DeleteMember("joe@example.com"); err != nil {
+		t.Fatalf("DeleteMember failed: %v", err)
+	}
+	if _, err := s.GetMember("joe@example.com"); err != ErrNotFound {
+		t.Errorf("GetMember after delete: got %v, want ErrNotFound", err)
+	}
+	members, err := s.Members()
+	if err != nil || len(members) != 1 {
+		t.Errorf("Members = %v, %v; want 1 member", members, err)
+	}
+
+	for i := 0; i < maxReports+5; i++ {
+		if err := s.AddReport(&ReconcileReport{Members: i}); err != nil {
+			t.Fatalf("AddReport failed: %v", err)
+		}
+	}
+	reports, err := s.Reports()
+	if err != nil {
+		t.Fatalf("Reports failed: %v", err)
+	}
+	if len(reports) != maxReports || reports[0].Members != maxReports+4 {
+		t.Errorf("Reports: got %d reports, newest with %d members; want %d, %d", len(reports), reports[0].Members, maxReports, maxReports+4)
+	}
+}
+
+func TestStoreRetry(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "janus.db"))
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	defer s.Close()
+
+	jobs := map[string]*Job{
+		"done":    {State: JobDone},
+		"dead":    {State: JobDead, Attempts: 8, LastError: "boom"},
+		"backoff": {State: JobPending, Attempts: 2, LastError: "boom"},
+		"new":     {State: JobPending},
+	}
+	for name, job := range jobs {
+		job.Payload = &OnboardingUser{Email: name + "@example.com"}
+		if err := s.Add(job); err != nil {
+			t.Fatalf("Add(%s) failed: %v", name, err)
+		}
+	}
+
+	now := time.Now().Add(time.Minute)
+	tests := []struct {
+		job          string
+		wantErr      error
+		wantAttempts int
+	}{
+		{job: "done", wantErr: ErrNotRetryable},
+		{job: "new", wantErr: ErrNotRetryable},
+		{job: "dead", wantAttempts: 0},
+		{job: "backoff", wantAttempts: 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.job, func(t *testing.T) {
+			job, err := s.retry(jobs[tc.job].ID, now)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("retry: got error %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if job.State != JobPending || !job.NextAttempt.Equal(now) || job.Attempts != tc.wantAttempts {
+				t.Errorf("retry: got state %s, next attempt %v, %d attempts; want pending, %v, %d", job.State, job.NextAttempt, job.Attempts, now, tc.wantAttempts)
+			}
+		})
+	}
+	if _, err := s.retry(1000, now); err != ErrNotFound {
+		t.Errorf("retry of missing job: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestStoreAddUnlessActive(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "janus.db"))
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	defer s.Close()
+
+	merged := 0
+	merge := func(existing *Job) error {
+		merged++
+		existing.Payload.Name = "merged"
+		return nil
+	}
+	add := func(email, handle string) (*Job, *Job, error) {
+		t.Helper()
+		job := &Job{State: JobPending, Payload: &OnboardingUser{Email: email, TelegramHandle: handle}}
+		existing, err := s.addUnlessActive(job, merge)
+		return job, existing, err
+	}
+	first, existing, err := add("jane@example.com", "")
+	if err != nil || existing != nil {
+		t.Fatalf("first addUnlessActive: got job %v, error %v", existing, err)
+	}
+	if _, existing, err := add("Jane@Example.com", ""); err != nil || existing == nil || existing.ID != first.ID {
+		t.Errorf("duplicate email: got job %v, error %v, want job %d", existing, err, first.ID)
+	}
+	if _, existing, err := add("jane@example.org", ""); err != nil || existing == nil || existing.ID != first.ID {
+		t.Errorf("duplicate username: got job %v, error %v, want job %d", existing, err, first.ID)
+	}
+	if merged != 2 {
+		t.Errorf("merge was called %d times, want 2", merged)
+	}
+	if job, err := s.Get(first.ID); err != nil || job.Payload.Name != "merged" {
+		t.Errorf("merged job: got %v, error %v, want the merged payload", job, err)
+	}
+	joe, existing, err := add("joe@example.com", "")
+	if err != nil || existing != nil {
+		t.Errorf("another user: got job %v, error %v, want a new job", existing, err)
+	}
+	if _, _, err := add("jane@example.com", "@joe"); !errors.Is(err, ErrBusy) {
+		t.Errorf("email and username of two jobs: got error %v, want ErrBusy", err)
+	}
+	if _, err := s.addUnlessActive(&Job{State: JobPending, Payload: &OnboardingUser{Email: "joe@example.com"}}, busyError); !errors.Is(err, ErrBusy) {
+		t.Errorf("failing merge: got error %v, want ErrBusy", err)
+	}
+
+	first.State = JobDone
+	if err := s.Put(first); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, existing, err := add("jane@example.com", ""); err != nil || existing != nil {
+		t.Errorf("after the job finished: got job %v, error %v, want a new job", existing, err)
+	}
+	if _, existing, err := add("joe@example.com", ""); err != nil || existing == nil || existing.ID != joe.ID {
+		t.Errorf("after another job finished: got job %v, error %v, want job %d", existing, err, joe.ID)
+	}
+}
@@ -0,0 +1,99 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Result reports what happened during a provisioning run.
+type Result struct {
+	Attempt          int            `json:"attempt,omitempty"`
+	Started          time.Time      `json:"started"`
+	Finished         time.Time      `json:"finished"`
+	GitlabUserID     int            `json:"gitlabUserID,omitempty"`
+	MattermostUserID string         `json:"mattermostUserID,omitempty"`
+	Steps            []StepResult   `json:"steps"`
+	WelcomeDM        string         `json:"welcomeDM,omitempty"` // "delivered", or why the welcome message was not.
+	ChecklistURL     string         `json:"checklistURL,omitempty"`
+	RolledBack       []string       `json:"rolledBack,omitempty"`
+	RollbackErrors   []string       `json:"rollbackErrors,omitempty"`
+	Error            string         `json:"error,omitempty"`
+	Conflict         *ConflictError `json:"conflict,omitempty"`
+}
+
+// StepResult records the outcome of a single provisioning step.
+type StepResult struct {
+	Name    string    `json:"name"`
+	At      time.Time `json:"at"` // when the step finished.
+	Error   string    `json:"error,omitempty"`
+	Skipped string    `json:"skipped,omitempty"` // reason the step was not needed.
+}
+
+// txn runs provisioning steps and remembers how to undo the ones that
+// succeeded, so that a failure part way through can be unwound.
+type txn struct {
+	res  *Result
+	undo []undoAction
+	plan *Plan // set once the run has been planned.
+}
+
+type undoAction struct {
+	name string
+	fn   func() error
+}
+
+func newTxn() *txn {
+	return &txn{res: &Result{Started: time.Now()}}
+}
+
+// do runs fn as the named step and records its outcome. If fn succeeds and
+// returns a non-nil undo function, it is scheduled to run on rollback.
+func (t *txn) do(name string, fn func() (undo func() error, err error)) error {
+	undo, err := fn()
+	step := StepResult{Name: name, At: time.Now()}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	t.res.Steps = append(t.res.Steps, step)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if undo != nil {
+		t.undo = append(t.undo, undoAction{name: name, fn: undo})
+	}
+	return nil
+}
+
+// onUndo schedules fn to run on rollback, for changes made outside of do.
+func (t *txn) onUndo(name string, fn func() error) {
+	t.undo = append(t.undo, undoAction{name: name, fn: fn})
+}
+
+// skip records that the named step was not needed, and why.
+func (t *txn) skip(name, reason string) {
+	t.res.Steps = append(t.res.Steps, StepResult{Name: name, At: time.Now(), Skipped: reason})
+}
+
+// fail records err as the reason the run failed.
+func (t *txn) fail(err error) {
+	t.res.Error = err.Error()
+	errors.As(err, &t.res.Conflict)
+}
+
+// rollback runs the recorded undo actions in reverse order. Undo actions
+// that fail are reported but do not stop the remaining ones from running.
+func (t *txn) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		u := t.undo[i]
+		if err := u.fn(); err != nil {
+			log.Printf("[ERROR] Rolling back %q: %v", u.name, err)
+			t.res.RollbackErrors = append(t.res.RollbackErrors, fmt.Sprintf("%s: %v", u.name, err))
+			continue
+		}
+		log.Printf("[INFO] Rolled back %q.", u.name)
+		t.res.RolledBack = append(t.res.RolledBack, u.name)
+	}
+	t.undo = nil
+}
@@ -0,0 +1,49 @@
+package provisioner
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestTxnRollback(t *testing.T) {
+	var undone []string
+	undo := func(name string, err error) func() error {
+		return func() error {
+			undone = append(undone, name)
+			return err
+		}
+	}
+
+	tx := newTxn()
+	_ = tx.do("first", func() (func() error, error) { return undo("first", nil), nil })
+	_ = tx.do("no undo", func() (func() error, error) { return nil, nil })
+	_ = tx.do("second", func() (func() error, error) { return undo("second", errors.New("boom")), nil })
+	_ = tx.do("third", func() (func() error, error) { return undo("third", nil), nil })
+	if err := tx.do("failing", func() (func() error, error) {
+		return undo("failing", nil), errors.New("failed")
+	}); err == nil {
+		t.Fatal("do() of failing step returned nil error")
+	}
+	tx.rollback()
+
+	want := &Result{
+		Steps: []StepResult{
+			{Name: "first"},
+			{Name: "no undo"},
+			{Name: "second"},
+			{Name: "third"},
+			{Name: "failing", Error: "failed"},
+		},
+		RolledBack:     []string{"third", "first"},
+		RollbackErrors: []string{"second: boom"},
+	}
+	if diff := cmp.Diff(want, tx.res, cmpopts.IgnoreFields(Result{}, "Started"), cmpopts.IgnoreFields(StepResult{}, "At")); diff != "" {
+		t.Error("Unexpected result diff (-want +got):\n", diff)
+	}
+	if diff := cmp.Diff([]string{"third", "second", "first"}, undone); diff != "" {
+		t.Error("Unexpected undo order diff (-want +got):\n", diff)
+	}
+}
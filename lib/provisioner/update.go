@@ -0,0 +1,375 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/xanzy/go-gitlab"
+	"gitlab.operationuplift.work/operations/development/janus/lib/actionlog"
+)
+
+// UpdateConfig configures how skill changes are applied.
+type UpdateConfig struct {
+	// RemoveStale removes memberships that no rule grants anymore. By
+	// default, updates only add memberships.
+	RemoveStale bool
+}
+
+// memberships is a set of memberships, keyed by gitlabKey, teamKey or
+// channelKey.
+type memberships map[string]bool
+
+func gitlabKey(g GitlabGrant) string {
+	if g.Group != "" {
+		return "group:" + g.Group
+	}
+	return "project:" + g.Project
+}
+
+func teamKey(id string) string    { return "team:" + id }
+func channelKey(id string) string { return "channel:" + id }
+
+// MembershipChanges is what an update does to a member's memberships.
+type MembershipChanges struct {
+	AddGitlab      []GitlabGrant  `json:"addGitlab,omitempty"`
+	RemoveGitlab   []GitlabGrant  `json:"removeGitlab,omitempty"`
+	AddTeams       []TeamGrant    `json:"addTeams,omitempty"`
+	RemoveTeams    []TeamGrant    `json:"removeTeams,omitempty"`
+	AddChannels    []ChannelGrant `json:"addChannels,omitempty"`
+	RemoveChannels []ChannelGrant `json:"removeChannels,omitempty"`
+}
+
+// diffMemberships compares the memberships the plan grants with the
+// current ones. Managed memberships that the plan does not grant are
+// removed if remove is set, unless they are sticky. Memberships Janus does
+// not manage are never touched. Teams and channels in the result carry no
+// nested channels.
+func diffMemberships(p *Plan, managedGitlab []GitlabGrant, managedTeams []TeamGrant, current, sticky memberships, remove bool) *MembershipChanges {
+	res := &MembershipChanges{}
+	desired := memberships{}
+
+	for _, g := range p.Gitlab {
+		desired[gitlabKey(g)] = true
+		if !current[gitlabKey(g)] {
+			res.AddGitlab = append(res.AddGitlab, g)
+		}
+	}
+	for _, tg := range p.Teams {
+		desired[teamKey(tg.TeamID)] = true
+		if !current[teamKey(tg.TeamID)] {
+			res.AddTeams = append(res.AddTeams, TeamGrant{Team: tg.Team, TeamID: tg.TeamID})
+		}
+		for _, cg := range tg.Channels {
+			desired[channelKey(cg.ID)] = true
+			if !current[channelKey(cg.ID)] {
+				res.AddChannels = append(res.AddChannels, cg)
+			}
+		}
+	}
+	if !remove {
+		return res
+	}
+
+	stale := func(key string) bool {
+		return current[key] && !desired[key] && !sticky[key]
+	}
+	for _, g := range managedGitlab {
+		if stale(gitlabKey(g)) {
+			res.RemoveGitlab = append(res.RemoveGitlab, g)
+		}
+	}
+	for _, tg := range managedTeams {
+		for _, cg := range tg.Channels {
+			if stale(channelKey(cg.ID)) {
+				res.RemoveChannels = append(res.RemoveChannels, cg)
+			}
+		}
+		if stale(teamKey(tg.TeamID)) {
+			res.RemoveTeams = append(res.RemoveTeams, TeamGrant{Team: tg.Team, TeamID: tg.TeamID})
+		}
+	}
+	return res
+}
+
+// stickyMemberships returns the memberships granted by sticky rules.
+func (h *Handler) stickyMemberships() (memberships, error) {
+	res := memberships{}
+	for _, rule := range h.Config.Rules {
+		if !rule.Sticky {
+			continue
+		}
+		for _, g := range rule.Gitlab {
+			res[gitlabKey(g)] = true
+		}
+		if rule.Team == "" {
+			continue
+		}
+		teamID, err := h.Names.Team(rule.Team)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		res[teamKey(teamID)] = true
+		for _, channel := range rule.Channels {
+			id, err := h.Names.Channel(teamID, channel)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+			}
+			res[channelKey(id)] = true
+		}
+	}
+	return res, nil
+}
+
+// Update re-evaluates the rules for the posted users, whose skills changed,
+// and applies the difference to their memberships. It accepts a flat
+// payload or a NocoDB update envelope, and answers with the action log.
+// Users busy with another operation are skipped, and the answer is a 409.
+func (h *Handler) Update(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if req.Body == nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	defer req.Body.Close()
+
+	users, err := h.updatedUsers(body)
+	if err != nil {
+		rejectPayload(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	alog := &actionlog.Log{Title: "Updating memberships"}
+	for _, u := range users {
+		le := alog.Addf("user %s", u.Email)
+		unlock, ok := h.lockIdentity(u)
+		if !ok {
+			le.Errorf("another operation for this user is in progress, try again later")
+			status = http.StatusConflict
+			continue
+		}
+		h.update(u, le)
+		unlock()
+	}
+	writeJSON(w, status, alog)
+}
+
+// updatedUsers decodes the users to update from a request body. Errors are
+// ValidationErrors.
+func (h *Handler) updatedUsers(body []byte) ([]*OnboardingUser, error) {
+	if !isEnvelope(body) {
+		u, err := h.decodeUser(body)
+		if err != nil {
+			return nil, err
+		}
+		return []*OnboardingUser{u}, nil
+	}
+
+	env := &nocoEnvelope{}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(env); err != nil {
+		return nil, decodeError(err)
+	}
+	if !has(nocoUpdateEvents, env.Type) {
+		return nil, ValidationError{{"type", fmt.Sprintf("unsupported event type %q", env.Type)}}
+	}
+	var res []*OnboardingUser
+	for i, raw := range env.Data.Rows {
+		u, err := h.decodeUser(raw)
+		if err != nil {
+			verr := err.(ValidationError)
+			for j := range verr {
+				verr[j].Field = fmt.Sprintf("data.rows[%d].%s", i, verr[j].Field)
+			}
+			return nil, verr
+		}
+		res = append(res, u)
+	}
+	log.Printf("[INFO] Received %s of %d row(s) from table %q.", env.Type, len(env.Data.Rows), env.Data.TableName)
+	return res, nil
+}
+
+// update brings a single user's memberships in line with the rules, logging
+// what it does.
+func (h *Handler) update(u *OnboardingUser, le *actionlog.Entity) {
+	p, err := h.plan(u)
+	if err != nil {
+		le.Errorf("planning: %v", err)
+		return
+	}
+	managedTeams, err := h.teamGrants(h.Config.Rules)
+	if err != nil {
+		le.Errorf("resolving teams and channels: %v", err)
+		return
+	}
+	sticky, err := h.stickyMemberships()
+	if err != nil {
+		le.Errorf("resolving sticky memberships: %v", err)
+		return
+	}
+
+	// Gitlab memberships only change if rules grant any, the global group
+	// and project were dealt with when provisioning.
+	current := memberships{}
+	var managedGitlab []GitlabGrant
+	var gitlabUser *gitlab.User
+	if h.Config.rulesGrantGitlab() {
+		managedGitlab = h.Config.managedGitlab()
+		if gitlabUser, err = h.findGitlabUserByEmail(u.Email); err != nil {
+			le.Errorf("searching gitlab user: %v", err)
+			return
+		}
+		if gitlabUser == nil {
+			le.Errorf("no gitlab account, provision the user first")
+			return
+		}
+		for _, g := range managedGitlab {
+			ok, err := h.isGitlabMember(g, gitlabUser.ID)
+			if err != nil {
+				le.Errorf("checking %s membership: %v", gitlabKey(g), err)
+				return
+			}
+			current[gitlabKey(g)] = ok
+		}
+	} else {
+		p.Gitlab = nil
+	}
+
+	mmUser, resp, err := h.Mattermost.GetUserByEmail(u.Email, "")
+	if err != nil {
+		if isNotFound(resp) {
+			le.Errorf("no mattermost account, provision the user first")
+		} else {
+			le.Errorf("getting mattermost user: %v", err)
+		}
+		return
+	}
+	for _, tg := range managedTeams {
+		ok, err := h.isTeamMember(tg.TeamID, mmUser.Id)
+		if err != nil {
+			le.Errorf("checking team %q membership: %v", tg.Team, err)
+			return
+		}
+		current[teamKey(tg.TeamID)] = ok
+		for _, cg := range tg.Channels {
+			if !ok {
+				break
+			}
+			isMember, err := h.isChannelMember(cg.ID, mmUser.Id)
+			if err != nil {
+				le.Errorf("checking channel %q membership: %v", cg.Channel, err)
+				return
+			}
+			current[channelKey(cg.ID)] = isMember
+		}
+	}
+
+	changes := diffMemberships(p, managedGitlab, managedTeams, current, sticky, h.Config.Updates.RemoveStale)
+	h.applyChanges(changes, gitlabUser, mmUser.Id, le)
+
+	// Reconciliation works from the skills recorded here.
+	if h.Jobs != nil {
+		m, err := h.Jobs.Store.GetMember(u.Email)
+		if errors.Is(err, ErrNotFound) {
+			m, err = &Member{Email: u.Email, MattermostUserID: mmUser.Id}, nil
+		}
+		if err == nil {
+			m.Payload = u
+			err = h.Jobs.Store.PutMember(m)
+		}
+		if err != nil {
+			log.Printf("[WARNING] Recording member %s: %v", u.Email, err)
+		}
+	}
+}
+
+// applyChanges applies membership changes, logging them. It keeps going
+// after errors.
+func (h *Handler) applyChanges(c *MembershipChanges, gitlabUser *gitlab.User, mmUserID string, le *actionlog.Entity) {
+	if len(c.AddGitlab)+len(c.RemoveGitlab)+len(c.AddTeams)+len(c.RemoveTeams)+len(c.AddChannels)+len(c.RemoveChannels) == 0 {
+		le.Logf("memberships are up to date")
+		return
+	}
+	for _, g := range c.AddGitlab {
+		var err error
+		if g.Group != "" {
+			_, _, err = h.Gitlab.GroupMembers.AddGroupMember(g.Group, &gitlab.AddGroupMemberOptions{
+				UserID:      gitlab.Int(gitlabUser.ID),
+				AccessLevel: gitlab.AccessLevel(gitlab.AccessLevelValue(g.Access)),
+				ExpiresAt:   stringPtr(g.Expires),
+			})
+		} else {
+			_, _, err = h.Gitlab.ProjectMembers.AddProjectMember(g.Project, &gitlab.AddProjectMemberOptions{
+				UserID:      gitlab.Int(gitlabUser.ID),
+				AccessLevel: gitlab.AccessLevel(gitlab.AccessLevelValue(g.Access)),
+				ExpiresAt:   stringPtr(g.Expires),
+			})
+		}
+		if err != nil {
+			le.Errorf("adding to gitlab %s: %v", gitlabKey(g), err)
+			continue
+		}
+		le.Logf("added to gitlab %s as %s", gitlabKey(g), g.Access)
+	}
+	for _, tg := range c.AddTeams {
+		if _, _, err := h.Mattermost.AddTeamMember(tg.TeamID, mmUserID); err != nil {
+			le.Errorf("adding to team %q: %v", tg.Team, err)
+			continue
+		}
+		le.Logf("added to team %q", tg.Team)
+	}
+	for _, cg := range c.AddChannels {
+		if _, _, err := h.Mattermost.AddChannelMember(cg.ID, mmUserID); err != nil {
+			le.Errorf("adding to channel %q: %v", cg.Channel, err)
+			continue
+		}
+		le.Logf("added to channel %q", cg.Channel)
+	}
+
+	for _, cg := range c.RemoveChannels {
+		if _, err := h.Mattermost.RemoveUserFromChannel(cg.ID, mmUserID); err != nil {
+			le.Errorf("removing from channel %q: %v", cg.Channel, err)
+			continue
+		}
+		le.Logf("removed from channel %q", cg.Channel)
+	}
+	for _, tg := range c.RemoveTeams {
+		if _, err := h.Mattermost.RemoveTeamMember(tg.TeamID, mmUserID); err != nil {
+			le.Errorf("removing from team %q: %v", tg.Team, err)
+			continue
+		}
+		le.Logf("removed from team %q", tg.Team)
+	}
+	for _, g := range c.RemoveGitlab {
+		var err error
+		if g.Group != "" {
+			_, err = h.Gitlab.GroupMembers.RemoveGroupMember(g.Group, gitlabUser.ID)
+		} else {
+			_, err = h.Gitlab.ProjectMembers.DeleteProjectMember(g.Project, gitlabUser.ID)
+		}
+		if err != nil {
+			le.Errorf("removing from gitlab %s: %v", gitlabKey(g), err)
+			continue
+		}
+		le.Logf("removed from gitlab %s", gitlabKey(g))
+	}
+}
+
+// rulesGrantGitlab reports whether any rule grants Gitlab access.
+func (c *Config) rulesGrantGitlab() bool {
+	for _, r := range c.Rules {
+		if len(r.Gitlab) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package provisioner
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffMemberships(t *testing.T) {
+	p := &Plan{
+		Gitlab: []GitlabGrant{{Group: "code"}, {Project: "docs/site"}},
+		Teams: []TeamGrant{{Team: "ops", TeamID: "t1", Channels: []ChannelGrant{
+			{Channel: "dev", ID: "c1"},
+			{Channel: "data", ID: "c2"},
+		}}},
+	}
+	managedGitlab := []GitlabGrant{{Group: "code"}, {Project: "docs/site"}, {Group: "analytics"}, {Group: "design"}}
+	managedTeams := []TeamGrant{
+		{Team: "ops", TeamID: "t1", Channels: []ChannelGrant{
+			{Channel: "dev", ID: "c1"},
+			{Channel: "data", ID: "c2"},
+			{Channel: "design", ID: "c3"},
+			{Channel: "alumni", ID: "c4"},
+		}},
+		{Team: "guests", TeamID: "t2", Channels: []ChannelGrant{{Channel: "lobby", ID: "c5"}}},
+	}
+	current := memberships{
+		"group:code":        true,
+		"group:analytics":   true,
+		"group:design":      true,
+		"team:t1":           true,
+		"channel:c1":        true,
+		"channel:c3":        true,
+		"channel:c4":        true,
+		"team:t2":           true,
+		"channel:c5":        true,
+		"channel:unmanaged": true,
+	}
+	sticky := memberships{"group:design": true, "channel:c4": true}
+
+	got := diffMemberships(p, managedGitlab, managedTeams, current, sticky, false)
+	want := &MembershipChanges{
+		AddGitlab:   []GitlabGrant{{Project: "docs/site"}},
+		AddChannels: []ChannelGrant{{Channel: "data", ID: "c2"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diffMemberships without removal mismatch (-want +got):\n%s", diff)
+	}
+
+	got = diffMemberships(p, managedGitlab, managedTeams, current, sticky, true)
+	want.RemoveGitlab = []GitlabGrant{{Group: "analytics"}}
+	want.RemoveChannels = []ChannelGrant{{Channel: "design", ID: "c3"}, {Channel: "lobby", ID: "c5"}}
+	want.RemoveTeams = []TeamGrant{{Team: "guests", TeamID: "t2"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diffMemberships with removal mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,191 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	mattermost "github.com/mattermost/mattermost-server/v6/model"
+	"github.com/xanzy/go-gitlab"
+)
+
+// UsernamePolicy configures how usernames are derived from onboarding
+// payloads.
+type UsernamePolicy struct {
+	// Reserved usernames are never given out, in addition to the names
+	// Gitlab and Mattermost reserve themselves.
+	Reserved []string
+
+	// Suffix is appended to a taken username to make it unique, with %d
+	// replaced by 2, 3 and so on. Defaults to "%d".
+	Suffix string
+
+	// MaxSuffix is the highest number tried before giving up. Defaults
+	// to 20.
+	MaxSuffix int
+}
+
+// Username length limits. The Mattermost API accepts longer usernames than
+// its own web app does, these are the limits of the latter.
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 22
+)
+
+// gitlabReserved are top-level paths Gitlab does not allow as usernames.
+var gitlabReserved = []string{
+	"admin", "api", "dashboard", "explore", "groups", "help", "import",
+	"oauth", "profile", "projects", "public", "root", "search", "snippets",
+	"uploads", "users",
+}
+
+var (
+	invalidUsernameChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+	usernameSpecialRuns  = regexp.MustCompile(`[._-]{2,}`)
+)
+
+// validate checks the collision suffix format.
+func (up *UsernamePolicy) validate() error {
+	if up.Suffix == "" {
+		return nil
+	}
+	if strings.Count(up.Suffix, "%d") != 1 || strings.Count(up.Suffix, "%") != 1 {
+		return fmt.Errorf("suffix %q must contain %%d exactly once", up.Suffix)
+	}
+	if suffix := fmt.Sprintf(up.Suffix, 2); invalidUsernameChars.MatchString(suffix) {
+		return fmt.Errorf("suffix %q contains characters not allowed in usernames", up.Suffix)
+	}
+	return nil
+}
+
+// normalizeUsername turns a handle into something that looks like a
+// username: no leading @, lowercase, invalid characters replaced, starting
+// with a letter and not ending with a special character. The result is not
+// necessarily valid, see checkUsername.
+func normalizeUsername(handle string) string {
+	s := strings.ToLower(strings.TrimSpace(handle))
+	s = strings.TrimPrefix(s, "@")
+	s = invalidUsernameChars.ReplaceAllString(s, "_")
+	s = usernameSpecialRuns.ReplaceAllStringFunc(s, func(run string) string {
+		return run[:1]
+	})
+	s = strings.TrimLeft(s, "0123456789._-")
+	if len(s) > maxUsernameLength {
+		s = s[:maxUsernameLength]
+	}
+	return strings.TrimRight(s, "._-")
+}
+
+// checkUsername checks a normalized username against the rules of both
+// Gitlab and Mattermost and the reserved names.
+func (up *UsernamePolicy) checkUsername(s string) error {
+	switch {
+	case len(s) < minUsernameLength || len(s) > maxUsernameLength:
+		return fmt.Errorf("must be %d to %d characters long", minUsernameLength, maxUsernameLength)
+	case s[0] < 'a' || s[0] > 'z':
+		return errors.New("must start with a letter")
+	case strings.HasSuffix(s, ".git") || strings.HasSuffix(s, ".atom"):
+		return errors.New("must not end with .git or .atom")
+	case !mattermost.IsValidUsername(s) || has(gitlabReserved, s):
+		return errors.New("is reserved or contains invalid characters")
+	}
+	for _, r := range up.Reserved {
+		if strings.EqualFold(r, s) {
+			return errors.New("is reserved")
+		}
+	}
+	return nil
+}
+
+// withSuffix returns the username with the collision suffix for n,
+// shortening it if needed to stay within the length limit.
+func (up *UsernamePolicy) withSuffix(base string, n int) string {
+	format := up.Suffix
+	if format == "" {
+		format = "%d"
+	}
+	suffix := fmt.Sprintf(format, n)
+	if max := maxUsernameLength - len(suffix); len(base) > max {
+		base = strings.TrimRight(base[:max], "._-")
+	}
+	return base + suffix
+}
+
+// chooseUsername derives the username for a user from their handle, falling
+// back to the local part of their email. taken reports whether a username
+// already belongs to someone with a different email; the first candidate
+// (with collision suffixes) that is valid and not taken wins.
+func (up *UsernamePolicy) chooseUsername(handle, email string, taken func(username string) (bool, error)) (string, error) {
+	maxSuffix := up.MaxSuffix
+	if maxSuffix <= 0 {
+		maxSuffix = 20
+	}
+
+	var problems []string
+	var localPart string
+	if i := strings.LastIndex(email, "@"); i > 0 {
+		localPart = email[:i]
+	}
+	for _, c := range []struct{ what, value string }{
+		{"handle", handle},
+		{"email local part", localPart},
+	} {
+		if strings.TrimSpace(c.value) == "" {
+			continue
+		}
+		base := normalizeUsername(c.value)
+		if err := up.checkUsername(base); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %q: username %q %v", c.what, c.value, base, err))
+			continue
+		}
+		for n := 1; n <= maxSuffix; n++ {
+			name := base
+			if n > 1 {
+				name = up.withSuffix(base, n)
+				if up.checkUsername(name) != nil {
+					continue
+				}
+			}
+			isTaken, err := taken(name)
+			if err != nil {
+				return "", fmt.Errorf("checking username %q: %w", name, err)
+			}
+			if !isTaken {
+				return name, nil
+			}
+		}
+		problems = append(problems, fmt.Sprintf("%s %q: username %q and its variants are taken", c.what, c.value, base))
+	}
+	if len(problems) == 0 {
+		return "", permanent(errors.New("field telegram_handle or email is required"))
+	}
+	return "", permanent(fmt.Errorf("no usable username: %s", strings.Join(problems, "; ")))
+}
+
+// usernameTaken reports whether the username belongs to a Gitlab or
+// Mattermost account with an email other than the given one.
+func (h *Handler) usernameTaken(username, email string) (bool, error) {
+	if h.lookupUsername != nil {
+		return h.lookupUsername(username, email)
+	}
+
+	users, _, err := h.Gitlab.Users.ListUsers(&gitlab.ListUsersOptions{Username: gitlab.String(username)})
+	if err != nil {
+		return false, fmt.Errorf("gitlab: %w", err)
+	}
+	for _, u := range users {
+		if !strings.EqualFold(u.Email, email) {
+			return true, nil
+		}
+	}
+
+	user, resp, err := h.Mattermost.GetUserByUsername(username, "")
+	if err != nil {
+		if isNotFound(resp) {
+			return false, nil
+		}
+		return false, fmt.Errorf("mattermost: %w", err)
+	}
+	return !strings.EqualFold(user.Email, email), nil
+}
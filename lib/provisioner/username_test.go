@@ -0,0 +1,63 @@
+package provisioner
+
+import (
+	"testing"
+)
+
+func TestChooseUsername(t *testing.T) {
+	policy := &UsernamePolicy{Reserved: []string{"Staff"}, Suffix: "_%d", MaxSuffix: 3}
+	if err := policy.validate(); err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+	taken := map[string]bool{
+		"jdoe":   true,
+		"jdoe_2": true,
+		"busy":   true,
+		"busy_2": true,
+		"busy_3": true,
+	}
+
+	for _, tc := range []struct {
+		handle, email string
+		want          string // empty if an error is expected.
+	}{
+		{"@Jane.Doe", "jane@example.com", "jane.doe"},
+		{"  jane doe ", "jane@example.com", "jane_doe"},
+		{"__jane..doe__", "jane@example.com", "jane.doe"},
+		{"1984jane", "jane@example.com", "jane"},
+		{"jdoe", "jane@example.com", "jdoe_3"},
+		{"a_very_long_handle_for_mattermost", "x@example.com", "a_very_long_handle_for"},
+		{"jo", "jo.smith@example.com", "jo.smith"},
+		{"", "jo.smith@example.com", "jo.smith"},
+		{"admin", "jo@example.com", ""},
+		{"staff", "staff@example.com", ""},
+		{"project.git", "jo@example.com", ""},
+		{"busy", "busy@example.com", ""},
+		{"", "", ""},
+	} {
+		got, err := policy.chooseUsername(tc.handle, tc.email, func(name string) (bool, error) {
+			return taken[name], nil
+		})
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("chooseUsername(%q, %q) = %q, want an error", tc.handle, tc.email, got)
+		case tc.want != "" && err != nil:
+			t.Errorf("chooseUsername(%q, %q) failed: %v", tc.handle, tc.email, err)
+		case got != tc.want:
+			t.Errorf("chooseUsername(%q, %q) = %q, want %q", tc.handle, tc.email, got, tc.want)
+		}
+	}
+}
+
+func TestUsernamePolicyValidate(t *testing.T) {
+	for _, suffix := range []string{"", "%d", "-%d", ".%d"} {
+		if err := (&UsernamePolicy{Suffix: suffix}).validate(); err != nil {
+			t.Errorf("validate(%q) failed: %v", suffix, err)
+		}
+	}
+	for _, suffix := range []string{"x", "%d%d", "%s", " %d", "%d%%"} {
+		if err := (&UsernamePolicy{Suffix: suffix}).validate(); err == nil {
+			t.Errorf("validate(%q): got no error", suffix)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError describes a problem with one field of an onboarding payload.
+// Field is the JSON key, or empty if the problem is with the payload as a
+// whole.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists everything wrong with an onboarding payload.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	var msgs []string
+	for _, fe := range e {
+		if fe.Field == "" {
+			msgs = append(msgs, fe.Message)
+		} else {
+			msgs = append(msgs, fe.Field+": "+fe.Message)
+		}
+	}
+	return "invalid payload: " + strings.Join(msgs, "; ")
+}
+
+// fieldSpec declares the constraints on an onboarding payload field.
+type fieldSpec struct {
+	field    string
+	value    func(u *OnboardingUser) string
+	required bool
+	maxLen   int                 // in characters.
+	check    func(string) string // returns a message if the value is invalid.
+}
+
+var onboardingSchema = []fieldSpec{
+	{
+		field:    "name",
+		value:    func(u *OnboardingUser) string { return u.Name },
+		required: true,
+		maxLen:   128,
+	},
+	{
+		field:    "email",
+		value:    func(u *OnboardingUser) string { return u.Email },
+		required: true,
+		maxLen:   128, // Mattermost's limit.
+		check:    checkEmail,
+	},
+	{
+		field:  "telegram_handle",
+		value:  func(u *OnboardingUser) string { return u.TelegramHandle },
+		maxLen: 64,
+	},
+	{
+		field:    "skills",
+		value:    func(u *OnboardingUser) string { return strings.Join(u.Skills(), ",") },
+		required: true,
+		maxLen:   1024,
+	},
+}
+
+// maxSkillLen is the length limit of a single skill.
+const maxSkillLen = 64
+
+// CheckPayload validates an onboarding payload against the schema and the
+// configured rules. It returns nil or a ValidationError.
+func (c *Config) CheckPayload(u *OnboardingUser) error {
+	var res ValidationError
+	for _, spec := range onboardingSchema {
+		v := strings.TrimSpace(spec.value(u))
+		switch {
+		case v == "":
+			if spec.required {
+				res = append(res, FieldError{spec.field, "is required"})
+			}
+		case utf8.RuneCountInString(v) > spec.maxLen:
+			res = append(res, FieldError{spec.field, fmt.Sprintf("must be at most %d characters long", spec.maxLen)})
+		case spec.check != nil:
+			if msg := spec.check(v); msg != "" {
+				res = append(res, FieldError{spec.field, msg})
+			}
+		}
+	}
+
+	for _, skill := range u.Skills() {
+		switch {
+		case utf8.RuneCountInString(skill) > maxSkillLen:
+			res = append(res, FieldError{"skills", fmt.Sprintf("skill %q must be at most %d characters long", skill, maxSkillLen)})
+		case !c.AllowUnknownSkills && !c.knownSkill(skill):
+			res = append(res, FieldError{"skills", fmt.Sprintf("unknown skill %q", skill)})
+		}
+	}
+
+	if len(res) > 0 {
+		return res
+	}
+	return nil
+}
+
+// knownSkill reports whether any rule mentions the skill. Without rules,
+// every skill is known.
+func (c *Config) knownSkill(skill string) bool {
+	if len(c.Rules) == 0 {
+		return true
+	}
+	skills := []string{skill}
+	for _, r := range c.Rules {
+		m := r.matcher
+		if m == nil {
+			panic("provisioner: rule used before Config.Validate")
+		}
+		if anyMatch(m.any, skills) || anyMatch(m.all, skills) || anyMatch(m.not, skills) {
+			return true
+		}
+	}
+	return false
+}
+
+// KnownSkills returns the skills rules match on, sorted. Skills of rules
+// using regular expressions are left out, as they are patterns.
+func (c *Config) KnownSkills() []string {
+	seen := map[string]bool{}
+	var res []string
+	for _, r := range c.Rules {
+		if r.Regex {
+			continue
+		}
+		skills := append([]string{r.Skill}, r.AnySkills...)
+		for _, s := range append(skills, r.AllSkills...) {
+			if s != "" && !seen[s] {
+				seen[s] = true
+				res = append(res, s)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func checkEmail(v string) string {
+	addr, err := mail.ParseAddress(v)
+	if err != nil || addr.Name != "" || addr.Address != v {
+		return "must be a plain email address, like jane@example.com"
+	}
+	if i := strings.LastIndex(v, "@"); !strings.Contains(v[i+1:], ".") {
+		return "must have a fully qualified domain"
+	}
+	return ""
+}
+
+// decodeError turns a JSON decoding error into a ValidationError.
+func decodeError(err error) error {
+	var terr *json.UnmarshalTypeError
+	var serr *json.SyntaxError
+	switch {
+	case errors.As(err, &terr):
+		return ValidationError{{terr.Field, fmt.Sprintf("must be %s, not %s", jsonKind(terr.Type), withArticle(terr.Value))}}
+	case errors.As(err, &serr):
+		return ValidationError{{"", fmt.Sprintf("invalid JSON at offset %d: %v", serr.Offset, err)}}
+	}
+	return ValidationError{{"", fmt.Sprintf("invalid JSON: %v", err)}}
+}
+
+// jsonKind describes the JSON value a Go type is decoded from.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+func withArticle(kind string) string {
+	switch kind {
+	case "array", "object":
+		return "an " + kind
+	case "bool":
+		return "a boolean"
+	}
+	return "a " + kind
+}
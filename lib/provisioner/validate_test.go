@@ -0,0 +1,122 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckPayload(t *testing.T) {
+	c := &Config{
+		Rules: []Rule{
+			{Name: "coders", AnySkills: []string{"Go", "Python"}},
+			{Name: "ops", AllSkills: []string{"ops.*"}, Regex: true, NotSkills: []string{"Windows"}},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		desc string
+		user OnboardingUser
+		want ValidationError
+	}{
+		{
+			desc: "valid",
+			user: OnboardingUser{Name: "Jane Doe", Email: "jane@example.com", RawSkills: "Go, ops-linux,Windows"},
+		},
+		{
+			desc: "empty",
+			user: OnboardingUser{Name: "  ", RawSkills: " , "},
+			want: ValidationError{
+				{"name", "is required"},
+				{"email", "is required"},
+				{"skills", "is required"},
+			},
+		},
+		{
+			desc: "bad values",
+			user: OnboardingUser{
+				Name:           "Jane",
+				Email:          "Jane <jane@example.com>",
+				TelegramHandle: strings.Repeat("j", 65),
+				RawSkills:      "Go,Cobol," + strings.Repeat("s", 65),
+			},
+			want: ValidationError{
+				{"email", "must be a plain email address, like jane@example.com"},
+				{"telegram_handle", "must be at most 64 characters long"},
+				{"skills", `unknown skill "Cobol"`},
+				{"skills", "skill \"" + strings.Repeat("s", 65) + "\" must be at most 64 characters long"},
+			},
+		},
+		{
+			desc: "local domain",
+			user: OnboardingUser{Name: "Jane", Email: "jane@localhost", RawSkills: "Go"},
+			want: ValidationError{{"email", "must have a fully qualified domain"}},
+		},
+	} {
+		var got ValidationError
+		if err := c.CheckPayload(&tc.user); err != nil {
+			got = err.(ValidationError)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: CheckPayload mismatch (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+
+	c.AllowUnknownSkills = true
+	if err := c.CheckPayload(&OnboardingUser{Name: "Jane", Email: "jane@example.com", RawSkills: "Cobol"}); err != nil {
+		t.Errorf("CheckPayload with unknown skills allowed: %v", err)
+	}
+}
+
+func TestReadPayloadsErrors(t *testing.T) {
+	h := &Handler{Config: &Config{}}
+	for _, tc := range []struct {
+		body string
+		want []FieldError
+	}{
+		{`{"telegram_handle": 42}`, []FieldError{{"telegram_handle", "must be a string, not a number"}}},
+		{`{"name": "Jane"`, []FieldError{{"", "invalid JSON at offset 15: unexpected end of JSON input"}}},
+		{`{"name": "Jane", "email": "jane"}`, []FieldError{
+			{"email", "must be a plain email address, like jane@example.com"},
+			{"skills", "is required"},
+		}},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/user/provision/", strings.NewReader(tc.body))
+		if _, _, ok := h.readPayloads(w, req, nil); ok {
+			t.Errorf("readPayloads(%s) succeeded, want an error", tc.body)
+			continue
+		}
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("readPayloads(%s): status %d, want %d", tc.body, w.Code, http.StatusUnprocessableEntity)
+		}
+		var got struct{ Errors []FieldError }
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		if diff := cmp.Diff(tc.want, got.Errors); diff != "" {
+			t.Errorf("readPayloads(%s) mismatch (-want +got):\n%s", tc.body, diff)
+		}
+	}
+}
+
+func TestKnownSkills(t *testing.T) {
+	c := &Config{Rules: []Rule{
+		{Name: "coders", Skill: "Programming"},
+		{Name: "analysts", AnySkills: []string{"Data analysis", "Statistics"}, NotSkills: []string{"Design"}},
+		{Name: "full stack", AllSkills: []string{"Programming", "Design"}},
+		{Name: "patterns", AnySkills: []string{"ops.*"}, Regex: true},
+		{Name: "staff", EmailDomains: []string{"example.com"}},
+	}}
+	want := []string{"Data analysis", "Design", "Programming", "Statistics"}
+	if diff := cmp.Diff(want, c.KnownSkills()); diff != "" {
+		t.Error("Unexpected KnownSkills diff (-want +got):\n", diff)
+	}
+}
@@ -0,0 +1,111 @@
+package provisioner
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	mattermost "github.com/mattermost/mattermost-server/v6/model"
+)
+
+// WelcomeData is what welcome message templates are executed on.
+type WelcomeData struct {
+	EmailData
+
+	// Memberships lists the teams the user was added to, each followed by
+	// its channels.
+	Memberships []WelcomeMembership
+}
+
+// WelcomeMembership is a Mattermost team or channel the user was added to.
+type WelcomeMembership struct {
+	Team    string   // team name, as configured.
+	Channel string   // channel name, as configured; empty for the team itself.
+	URL     string   // link to the team or channel.
+	Rules   []string // names of the rules that granted it.
+}
+
+// compileWelcomeMessage parses a welcome message template.
+func compileWelcomeMessage(text string) (*template.Template, error) {
+	return compileTemplate("welcome", text, &WelcomeData{
+		EmailData: sampleEmailData,
+		Memberships: []WelcomeMembership{
+			{Team: "team", Rules: []string{"rule"}},
+			{Team: "team", Channel: "channel", Rules: []string{"rule"}},
+		},
+	})
+}
+
+// welcomeData collects the data available to the welcome message from a
+// plan.
+func (h *Handler) welcomeData(p *Plan) *WelcomeData {
+	data := &WelcomeData{EmailData: *h.emailData(p)}
+	base := strings.TrimSuffix(h.MattermostURL, "/")
+	grantedBy := func(team, channel string) []string {
+		var res []string
+		for _, r := range p.Rules {
+			if r.Team == team && (channel == "" || has(r.Channels, channel)) {
+				res = append(res, r.Name)
+			}
+		}
+		return res
+	}
+	for _, tg := range p.Teams {
+		teamURL := base + "/" + h.Names.URLName(tg.TeamID)
+		data.Memberships = append(data.Memberships, WelcomeMembership{
+			Team:  tg.Team,
+			URL:   teamURL,
+			Rules: grantedBy(tg.Team, ""),
+		})
+		for _, cg := range tg.Channels {
+			data.Memberships = append(data.Memberships, WelcomeMembership{
+				Team:    tg.Team,
+				Channel: cg.Channel,
+				URL:     teamURL + "/channels/" + h.Names.URLName(cg.ID),
+				Rules:   grantedBy(tg.Team, cg.Channel),
+			})
+		}
+	}
+	return data
+}
+
+// welcomeMessage renders the welcome message for the plan, using the
+// template of the highest priority matching rule that has one, or else the
+// global one. It returns an empty string if there is no template.
+func (h *Handler) welcomeMessage(p *Plan, rules []Rule) (string, error) {
+	tmpl := h.Config.welcomeMsg
+	for _, r := range rules {
+		if r.welcomeMsg != nil {
+			tmpl = r.welcomeMsg
+			break
+		}
+	}
+	if tmpl == nil {
+		return "", nil
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, h.welcomeData(p)); err != nil {
+		return "", fmt.Errorf("rendering welcome message: %w", err)
+	}
+	return sb.String(), nil
+}
+
+// sendWelcomeMessage sends the welcome message to the user as a direct
+// message from the bot.
+func (h *Handler) sendWelcomeMessage(message, userID string) error {
+	bot, _, err := h.Mattermost.GetMe("")
+	if err != nil {
+		return fmt.Errorf("getting bot user: %w", err)
+	}
+	channel, _, err := h.Mattermost.CreateDirectChannel(bot.Id, userID)
+	if err != nil {
+		return fmt.Errorf("creating direct channel: %w", err)
+	}
+	if _, _, err := h.Mattermost.CreatePost(&mattermost.Post{
+		ChannelId: channel.Id,
+		Message:   message,
+	}); err != nil {
+		return fmt.Errorf("posting message: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package provisioner
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWelcomeMessage(t *testing.T) {
+	h := &Handler{
+		GitlabURL:     "https://gitlab.example.com",
+		MattermostURL: "https://chat.example.com/",
+		lookupUsername: func(username, email string) (bool, error) {
+			return false, nil
+		},
+	}
+	h.Config = &Config{
+		WelcomeMessage: `Hi {{.FirstName}}!
+{{range .Memberships}}* [{{or .Channel .Team}}]({{.URL}}) ({{join .Rules ", "}})
+{{end}}Set your password at {{.PasswordURL}}`,
+		Rules: []Rule{
+			{Name: "coders", Skill: "Programming", Team: "team1", Channels: []string{"dev", "general"}},
+			{Name: "analysts", Skill: "Data analysis", Team: "team1", Channels: []string{"general"}},
+			{Name: "designers", Skill: "Design", Team: "team2", Priority: 1, WelcomeMessage: "Hi {{.FirstName}}, welcome to the design team."},
+		},
+	}
+	if err := h.Config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name, skills, want string
+	}{
+		{
+			name:   "global template",
+			skills: "Programming,Data analysis",
+			want: `Hi Jane!
+* [team1](https://chat.example.com/team1) (coders, analysts)
+* [dev](https://chat.example.com/team1/channels/dev) (coders)
+* [general](https://chat.example.com/team1/channels/general) (coders, analysts)
+Set your password at https://gitlab.example.com/users/password/new`,
+		},
+		{
+			name:   "rule template",
+			skills: "Programming,Design",
+			want:   "Hi Jane, welcome to the design team.",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := h.plan(&OnboardingUser{Name: "Jane Doe", Email: "jane@example.com", RawSkills: tc.skills})
+			if err != nil {
+				t.Fatalf("plan failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, p.WelcomeMessage); diff != "" {
+				t.Error("Unexpected welcome message diff (-want +got):\n", diff)
+			}
+		})
+	}
+}
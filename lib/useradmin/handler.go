@@ -1,16 +1,21 @@
 package useradmin
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"path"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 	mattermost "github.com/mattermost/mattermost-server/v6/model"
 	"github.com/unrolled/render"
 	"github.com/xanzy/go-gitlab"
+	"gitlab.operationuplift.work/operations/development/janus/lib/actionlog"
 	"gitlab.operationuplift.work/operations/development/janus/lib/auth"
+	"gitlab.operationuplift.work/operations/development/janus/lib/provisioner"
 )
 
 type Handler struct {
@@ -19,6 +24,8 @@ type Handler struct {
 	Config     *Config
 	Gitlab     *gitlab.Client
 	Mattermost *mattermost.Client4
+	Reconciler *provisioner.Reconciler // optional, enables the reconciliation page.
+	Jobs       *provisioner.Queue      // optional, enables the provisioning job pages.
 }
 
 // RegisterRoutes configures the router with the routes to handle useradmin
@@ -26,6 +33,24 @@ type Handler struct {
 func (h *Handler) RegisterRoutes(r *httprouter.Router, prefix string) {
 	r.GET(prefix+"/", auth.MustHaveGroup(h.Render, "management", h.listUsers))
 	r.POST(prefix+"/", auth.MustHaveGroup(h.Render, "management", h.updateUsers))
+	if h.Reconciler != nil {
+		r.GET(prefix+"/reconcile", auth.MustHaveGroup(h.Render, "management", h.listReports))
+		r.POST(prefix+"/reconcile", auth.MustHaveGroup(h.Render, "management", h.reconcile))
+	}
+	if h.Jobs != nil {
+		r.GET(prefix+"/jobs", auth.MustHaveGroup(h.Render, "management", h.listJobs))
+		r.GET(prefix+"/jobs/:id", auth.MustHaveGroup(h.Render, "management", h.showJob))
+		r.POST(prefix+"/jobs/:id/retry", auth.MustHaveGroup(h.Render, "management", h.retryJob))
+		r.GET(prefix+"/onboard", auth.MustHaveGroup(h.Render, "management", h.onboardForm))
+		r.POST(prefix+"/onboard", auth.MustHaveGroup(h.Render, "management", h.onboard))
+
+		approvers := h.Config.ApproverGroup
+		if approvers == "" {
+			approvers = "management"
+		}
+		r.GET(prefix+"/approvals", auth.MustHaveGroup(h.Render, approvers, h.listApprovals))
+		r.POST(prefix+"/approvals/:id", auth.MustHaveGroup(h.Render, approvers, h.reviewJob))
+	}
 }
 
 func (h *Handler) listUsers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -96,7 +121,7 @@ func (h *Handler) updateUsers(w http.ResponseWriter, r *http.Request, _ httprout
 		return
 	}
 
-	var alog actionLog
+	var alog actionlog.Log
 	switch r.FormValue("action") {
 	case "block":
 		alog = h.blockUsers(users)
@@ -114,148 +139,321 @@ func (h *Handler) updateUsers(w http.ResponseWriter, r *http.Request, _ httprout
 	h.HTML(w, http.StatusOK, "useradmin/actionlog", alog)
 }
 
-func (h *Handler) blockUsers(users []int) actionLog {
-	alog := actionLog{
+func (h *Handler) blockUsers(users []int) actionlog.Log {
+	alog := actionlog.Log{
 		Title: "Blocking users",
 	}
 
 	for _, uid := range users {
 		user, _, err := h.Gitlab.Users.GetUser(uid, gitlab.GetUsersOptions{})
 		if err != nil {
-			alog.addf("user id %d", uid).errorf("getting user from gitlab: %v", sanitize(err))
+			alog.Addf("user id %d", uid).Errorf("getting user from gitlab: %v", sanitize(err))
 			continue
 		}
-		le := alog.addf("user %s (id %d)", user.Username, uid)
+		le := alog.Addf("user %s (id %d)", user.Username, uid)
 		if user.IsAdmin {
-			le.errorf("blocking gitlab admin account not allowed")
+			le.Errorf("blocking gitlab admin account not allowed")
 			continue
 		}
 		if user.State == "blocked" {
-			le.errorf("account was already blocked")
+			le.Errorf("account was already blocked")
 			continue
 		}
-		le.logf("account state was previously %q", user.State)
+		le.Logf("account state was previously %q", user.State)
 		if err := h.Gitlab.Users.BlockUser(uid); err != nil {
-			le.errorf("blocking gitlab account failed: %v", sanitize(err))
+			le.Errorf("blocking gitlab account failed: %v", sanitize(err))
 			continue
 		}
-		le.logf("gitlab account is now blocked")
+		le.Logf("gitlab account is now blocked")
 
 		mmUser, _, err := h.Mattermost.GetUserByUsername(user.Username, "")
 		if err != nil {
-			le.errorf("looking up mattermost user: %v", sanitize(err))
+			le.Errorf("looking up mattermost user: %v", sanitize(err))
 			continue
 		}
 		if _, err := h.Mattermost.UpdateUserActive(mmUser.Id, false); err != nil {
-			le.errorf("updating mattermost account: %v", sanitize(err))
+			le.Errorf("updating mattermost account: %v", sanitize(err))
 			continue
 		}
-		le.logf("mattermost account is now disabled")
+		le.Logf("mattermost account is now disabled")
 	}
 	return alog
 }
 
-func (h *Handler) unblockUsers(users []int) actionLog {
-	alog := actionLog{
+func (h *Handler) unblockUsers(users []int) actionlog.Log {
+	alog := actionlog.Log{
 		Title: "Unblocking users",
 	}
 	for _, uid := range users {
 		user, _, err := h.Gitlab.Users.GetUser(uid, gitlab.GetUsersOptions{})
 		if err != nil {
-			alog.addf("user id %d", uid).errorf("getting user from gitlab: %v", sanitize(err))
+			alog.Addf("user id %d", uid).Errorf("getting user from gitlab: %v", sanitize(err))
 			continue
 		}
-		le := alog.addf("user %s (id %d)", user.Username, uid)
+		le := alog.Addf("user %s (id %d)", user.Username, uid)
 		if user.IsAdmin {
-			le.errorf("unblocking gitlab admin account not allowed")
+			le.Errorf("unblocking gitlab admin account not allowed")
 			continue
 		}
 		if user.State == "active" {
-			le.errorf("account was already active")
+			le.Errorf("account was already active")
 			continue
 		}
-		le.logf("account state was previously %q", user.State)
+		le.Logf("account state was previously %q", user.State)
 		if err := h.Gitlab.Users.UnblockUser(uid); err != nil {
-			le.errorf("unblocking gitlab account failed: %v", sanitize(err))
+			le.Errorf("unblocking gitlab account failed: %v", sanitize(err))
 			continue
 		}
-		le.logf("gitlab account is now unblocked")
+		le.Logf("gitlab account is now unblocked")
 
 		mmUser, _, err := h.Mattermost.GetUserByUsername(user.Username, "")
 		if err != nil {
-			le.errorf("looking up mattermost user: %v", sanitize(err))
+			le.Errorf("looking up mattermost user: %v", sanitize(err))
 			continue
 		}
 		if _, err := h.Mattermost.UpdateUserActive(mmUser.Id, true); err != nil {
-			le.errorf("updating mattermost account: %v", sanitize(err))
+			le.Errorf("updating mattermost account: %v", sanitize(err))
 			continue
 		}
-		le.logf("mattermost account is now active")
+		le.Logf("mattermost account is now active")
 	}
 	return alog
 }
 
-func (h *Handler) addGroup(users []int, group string) actionLog {
-	alog := actionLog{
+func (h *Handler) addGroup(users []int, group string) actionlog.Log {
+	alog := actionlog.Log{
 		Title: "Adding users to group",
 	}
 	gid := findGroup(h.Config.Groups, group)
 	if gid == 0 {
-		alog.addf("internal server error").errorf("could not find group %q", group)
+		alog.Addf("internal server error").Errorf("could not find group %q", group)
 		return alog
 	}
 	for _, uid := range users {
 		user, _, err := h.Gitlab.Users.GetUser(uid, gitlab.GetUsersOptions{})
 		if err != nil {
-			alog.addf("user id %d", uid).errorf("getting user from gitlab: %v", sanitize(err))
+			alog.Addf("user id %d", uid).Errorf("getting user from gitlab: %v", sanitize(err))
 			continue
 		}
-		le := alog.addf("user %s (id %d)", user.Username, uid)
+		le := alog.Addf("user %s (id %d)", user.Username, uid)
 		if user.State != "active" {
-			le.errorf("account is blocked, cannot make changes")
+			le.Errorf("account is blocked, cannot make changes")
 			continue
 		}
 		if _, _, err := h.Gitlab.GroupMembers.AddGroupMember(gid, &gitlab.AddGroupMemberOptions{
 			UserID:      gitlab.Int(uid),
 			AccessLevel: gitlab.AccessLevel(gitlab.GuestPermissions),
 		}); err != nil {
-			le.errorf("failed to add group: %v", sanitize(err))
+			le.Errorf("failed to add group: %v", sanitize(err))
 			continue
 		}
-		le.logf("user added to group %q", group)
+		le.Logf("user added to group %q", group)
 	}
 	return alog
 }
 
-func (h *Handler) removeGroup(users []int, group string) actionLog {
-	alog := actionLog{
+func (h *Handler) removeGroup(users []int, group string) actionlog.Log {
+	alog := actionlog.Log{
 		Title: "Removing users from group",
 	}
 	gid := findGroup(h.Config.Groups, group)
 	if gid == 0 {
-		alog.addf("internal server error").errorf("could not find group %q", group)
+		alog.Addf("internal server error").Errorf("could not find group %q", group)
 		return alog
 	}
 	for _, uid := range users {
 		user, _, err := h.Gitlab.Users.GetUser(uid, gitlab.GetUsersOptions{})
 		if err != nil {
-			alog.addf("user id %d", uid).errorf("getting user from gitlab: %v", sanitize(err))
+			alog.Addf("user id %d", uid).Errorf("getting user from gitlab: %v", sanitize(err))
 			continue
 		}
-		le := alog.addf("user %s (id %d)", user.Username, uid)
+		le := alog.Addf("user %s (id %d)", user.Username, uid)
 		if user.State != "active" {
-			le.errorf("account is blocked, cannot make changes")
+			le.Errorf("account is blocked, cannot make changes")
 			continue
 		}
 		if _, err := h.Gitlab.GroupMembers.RemoveGroupMember(gid, uid); err != nil {
-			le.errorf("failed to remove group: %v", sanitize(err))
+			le.Errorf("failed to remove group: %v", sanitize(err))
 			continue
 		}
-		le.logf("user removed from group %q", group)
+		le.Logf("user removed from group %q", group)
 	}
 	return alog
 }
 
+func (h *Handler) listReports(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	reports, err := h.Reconciler.Store.Reports()
+	if err != nil {
+		log.Printf("[ERROR] Listing reconciliation reports: %v", err)
+		h.HTML(w, http.StatusInternalServerError, "error", "Error listing reports.")
+		return
+	}
+	h.HTML(w, http.StatusOK, "useradmin/reconcile", reports)
+}
+
+func (h *Handler) reconcile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if _, err := h.Reconciler.Reconcile(); err != nil {
+		log.Printf("[ERROR] Reconciling memberships: %v", err)
+		h.HTML(w, http.StatusInternalServerError, "error", "Error reconciling memberships.")
+		return
+	}
+	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+}
+
+func (h *Handler) listJobs(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	type jobListData struct {
+		Jobs   []*provisioner.Job
+		State  string
+		Email  string
+		States []provisioner.JobState
+	}
+
+	data := &jobListData{
+		State: r.FormValue("state"),
+		Email: strings.TrimSpace(r.FormValue("email")),
+		States: []provisioner.JobState{
+			provisioner.JobAwaitingApproval,
+			provisioner.JobRejected,
+			provisioner.JobPending,
+			provisioner.JobRunning,
+			provisioner.JobDone,
+			provisioner.JobDead,
+		},
+	}
+	email := strings.ToLower(data.Email)
+	jobs, err := h.Jobs.Store.List(func(job *provisioner.Job) bool {
+		if data.State != "" && string(job.State) != data.State {
+			return false
+		}
+		return email == "" || strings.Contains(strings.ToLower(job.Payload.Email), email)
+	})
+	if err != nil {
+		log.Printf("[ERROR] Listing provisioning jobs: %v", err)
+		h.HTML(w, http.StatusInternalServerError, "error", "Error listing jobs.")
+		return
+	}
+	data.Jobs = jobs
+	h.HTML(w, http.StatusOK, "useradmin/jobs", data)
+}
+
+func (h *Handler) showJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, err := strconv.ParseUint(ps.ByName("id"), 10, 64)
+	if err != nil {
+		h.HTML(w, http.StatusNotFound, "error", "Job not found.")
+		return
+	}
+	job, err := h.Jobs.Store.Get(id)
+	switch {
+	case errors.Is(err, provisioner.ErrNotFound):
+		h.HTML(w, http.StatusNotFound, "error", "Job not found.")
+		return
+	case err != nil:
+		log.Printf("[ERROR] Getting provisioning job %d: %v", id, err)
+		h.HTML(w, http.StatusInternalServerError, "error", "Error getting job.")
+		return
+	}
+	h.HTML(w, http.StatusOK, "useradmin/job", job)
+}
+
+func (h *Handler) retryJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, err := strconv.ParseUint(ps.ByName("id"), 10, 64)
+	if err != nil {
+		h.HTML(w, http.StatusNotFound, "error", "Job not found.")
+		return
+	}
+	_, err = h.Jobs.Retry(id)
+	switch {
+	case errors.Is(err, provisioner.ErrNotFound):
+		h.HTML(w, http.StatusNotFound, "error", "Job not found.")
+		return
+	case errors.Is(err, provisioner.ErrNotRetryable):
+		h.HTML(w, http.StatusConflict, "error", "Only failed jobs can be retried.")
+		return
+	case err != nil:
+		log.Printf("[ERROR] Retrying provisioning job %d: %v", id, err)
+		h.HTML(w, http.StatusInternalServerError, "error", "Error retrying job.")
+		return
+	}
+	http.Redirect(w, r, strings.TrimSuffix(r.URL.Path, "/retry"), http.StatusSeeOther)
+}
+
+func (h *Handler) listApprovals(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	type requestData struct {
+		Job   *provisioner.Job
+		Rules []string
+	}
+	type approvalData struct {
+		Requests  []requestData
+		CanNotify bool
+	}
+
+	jobs, err := h.Jobs.Store.List(func(job *provisioner.Job) bool {
+		return job.State == provisioner.JobAwaitingApproval
+	})
+	if err != nil {
+		log.Printf("[ERROR] Listing provisioning jobs: %v", err)
+		h.HTML(w, http.StatusInternalServerError, "error", "Error listing requests.")
+		return
+	}
+	cfg := h.Jobs.Handler.Config
+	data := &approvalData{CanNotify: cfg.Approval.RejectTemplate != ""}
+	for _, job := range jobs {
+		req := requestData{Job: job}
+		for _, rule := range cfg.MatchingRules(job.Payload) {
+			req.Rules = append(req.Rules, rule.Name)
+		}
+		data.Requests = append(data.Requests, req)
+	}
+	h.HTML(w, http.StatusOK, "useradmin/approvals", data)
+}
+
+func (h *Handler) reviewJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, err := strconv.ParseUint(ps.ByName("id"), 10, 64)
+	if err != nil {
+		h.HTML(w, http.StatusNotFound, "error", "Request not found.")
+		return
+	}
+	user, err := auth.Get(r)
+	if err != nil {
+		h.HTML(w, http.StatusUnauthorized, "error", "You do not have access to this resource.")
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "approve":
+		_, err = h.Jobs.Approve(id, user.Username)
+	case "reject":
+		reason := strings.TrimSpace(r.FormValue("reason"))
+		if reason == "" {
+			h.HTML(w, http.StatusBadRequest, "error", "A reason is required to reject a request.")
+			return
+		}
+		var job *provisioner.Job
+		job, err = h.Jobs.Reject(r.Context(), id, user.Username, reason, r.FormValue("notify") != "")
+		if job != nil && err != nil {
+			log.Printf("[ERROR] Notifying rejected applicant of job %d: %v", id, err)
+			h.HTML(w, http.StatusInternalServerError, "error", "The request was rejected, but the applicant could not be notified.")
+			return
+		}
+	default:
+		h.HTML(w, http.StatusNotImplemented, "error", "Unsupported action.")
+		return
+	}
+	switch {
+	case errors.Is(err, provisioner.ErrNotFound):
+		h.HTML(w, http.StatusNotFound, "error", "Request not found.")
+		return
+	case errors.Is(err, provisioner.ErrNotAwaitingApproval):
+		h.HTML(w, http.StatusConflict, "error", "The request was already reviewed.")
+		return
+	case err != nil:
+		log.Printf("[ERROR] Reviewing provisioning job %d: %v", id, err)
+		h.HTML(w, http.StatusInternalServerError, "error", "Error reviewing request.")
+		return
+	}
+	http.Redirect(w, r, path.Dir(r.URL.Path), http.StatusSeeOther)
+}
+
 func (h *Handler) getGroupMembers(gid int) map[int]bool {
 	members, _, err := h.Gitlab.Groups.ListGroupMembers(gid, &gitlab.ListGroupMembersOptions{
 		ListOptions: gitlab.ListOptions{
@@ -0,0 +1,144 @@
+package useradmin
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"gitlab.operationuplift.work/operations/development/janus/lib/actionlog"
+	"gitlab.operationuplift.work/operations/development/janus/lib/auth"
+	"gitlab.operationuplift.work/operations/development/janus/lib/provisioner"
+)
+
+type skillOption struct {
+	Name     string
+	Selected bool
+}
+
+type onboardData struct {
+	User        *provisioner.OnboardingUser
+	Skills      []skillOption
+	OtherSkills string // comma separated skills not in the list.
+	Errors      provisioner.ValidationError
+	Plan        *provisioner.Plan
+}
+
+func (h *Handler) onboardForm(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.HTML(w, http.StatusOK, "useradmin/onboard", h.onboardData(r))
+}
+
+// onboard shows the plan for the submitted user, or provisions them once
+// the plan is confirmed.
+func (h *Handler) onboard(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := r.ParseForm(); err != nil {
+		log.Printf("[WARNING] Invalid form data in onboard: %v", err)
+		h.HTML(w, http.StatusBadRequest, "error", "Bad request.")
+		return
+	}
+	data := h.onboardData(r)
+	p, err := h.Jobs.Handler.DryRun(data.User)
+	var verr provisioner.ValidationError
+	switch {
+	case errors.As(err, &verr):
+		data.Errors = verr
+		h.HTML(w, http.StatusUnprocessableEntity, "useradmin/onboard", data)
+		return
+	case err != nil:
+		data.Errors = provisioner.ValidationError{{Message: err.Error()}}
+		h.HTML(w, http.StatusUnprocessableEntity, "useradmin/onboard", data)
+		return
+	}
+	if r.PostFormValue("action") != "provision" {
+		data.Plan = p
+		h.HTML(w, http.StatusOK, "useradmin/onboard", data)
+		return
+	}
+
+	user, err := auth.Get(r)
+	if err != nil {
+		h.HTML(w, http.StatusUnauthorized, "error", "You do not have access to this resource.")
+		return
+	}
+	job, err := h.Jobs.Run(r.Context(), data.User, user.Username)
+	if errors.Is(err, provisioner.ErrBusy) {
+		h.HTML(w, http.StatusConflict, "error", fmt.Sprintf("Cannot provision %s now: %v.", data.User.Email, err))
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Provisioning %s: %v", data.User.Email, err)
+		h.HTML(w, http.StatusInternalServerError, "error", "Error provisioning user.")
+		return
+	}
+	alog := jobLog(job)
+	alog.RefURL = r.URL.Path
+	h.HTML(w, http.StatusOK, "useradmin/actionlog", alog)
+}
+
+// onboardData reads the onboarding form, and lists the skills to choose
+// from.
+func (h *Handler) onboardData(r *http.Request) *onboardData {
+	selected := map[string]bool{}
+	var skills []string
+	for _, s := range r.Form["skill"] {
+		selected[s] = true
+		skills = append(skills, s)
+	}
+	other := strings.TrimSpace(r.FormValue("other_skills"))
+	if other != "" {
+		skills = append(skills, other)
+	}
+	data := &onboardData{
+		User: &provisioner.OnboardingUser{
+			Name:           strings.TrimSpace(r.FormValue("name")),
+			Email:          strings.TrimSpace(r.FormValue("email")),
+			TelegramHandle: strings.TrimSpace(r.FormValue("telegram_handle")),
+			RawSkills:      strings.Join(skills, ","),
+		},
+		OtherSkills: other,
+	}
+	for _, s := range h.Jobs.Handler.Config.KnownSkills() {
+		data.Skills = append(data.Skills, skillOption{Name: s, Selected: selected[s]})
+	}
+	return data
+}
+
+// jobLog describes the latest attempt of a job as an action log.
+func jobLog(job *provisioner.Job) actionlog.Log {
+	alog := actionlog.Log{
+		Title: fmt.Sprintf("Provisioning %s (job %d)", job.Payload.Email, job.ID),
+	}
+	le := alog.Addf("user %s", job.Payload.Email)
+	res := job.Latest()
+	if res == nil {
+		le.Errorf("did not run, another operation for this user is in progress; it will be retried at %s", job.NextAttempt.Format("15:04:05"))
+		return alog
+	}
+	for _, step := range res.Steps {
+		switch {
+		case step.Error != "":
+			le.Errorf("%s: %s", step.Name, step.Error)
+		case step.Skipped != "":
+			le.Logf("%s: skipped, %s", step.Name, step.Skipped)
+		default:
+			le.Logf("%s", step.Name)
+		}
+	}
+	for _, name := range res.RolledBack {
+		le.Logf("rolled back %s", name)
+	}
+	for _, msg := range res.RollbackErrors {
+		le.Errorf("rolling back %s", msg)
+	}
+	switch job.State {
+	case provisioner.JobDone:
+		le.Logf("provisioned successfully")
+	case provisioner.JobPending:
+		le.Errorf("failed, will be retried at %s: %s", job.NextAttempt.Format("15:04:05"), job.LastError)
+	default:
+		le.Errorf("failed: %s", job.LastError)
+	}
+	return alog
+}
@@ -0,0 +1,68 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestVerify(t *testing.T) {
+	fixed := time.Unix(1640000000, 0)
+	now = func() time.Time { return fixed }
+	defer func() { now = time.Now }()
+
+	cfg := &Config{Secret: "s3cret", Token: "t0ken", ReplayWindow: 5 * time.Minute}
+	body := `{"email":"someone@example.com"}`
+
+	signed := func(secret string, ts time.Time, body string) http.Header {
+		h := http.Header{}
+		h.Set(TimestampHeader, strconv.FormatInt(ts.Unix(), 10))
+		h.Set(SignatureHeader, Sign(secret, ts, []byte(body)))
+		return h
+	}
+	bearer := func(token string) http.Header {
+		h := http.Header{}
+		h.Set("Authorization", "Bearer "+token)
+		return h
+	}
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		body   string
+		want   int
+	}{
+		{"valid signature", signed("s3cret", fixed, body), body, http.StatusOK},
+		{"slightly skewed clock", signed("s3cret", fixed.Add(time.Minute), body), body, http.StatusOK},
+		{"valid token", bearer("t0ken"), body, http.StatusOK},
+		{"invalid token", bearer("nope"), body, http.StatusUnauthorized},
+		{"unsigned", http.Header{}, body, http.StatusUnauthorized},
+		{"wrong secret", signed("other", fixed, body), body, http.StatusUnauthorized},
+		{"tampered body", signed("s3cret", fixed, body), body + " ", http.StatusUnauthorized},
+		{"stale", signed("s3cret", fixed.Add(-6*time.Minute), body), body, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotBody string
+			h := Verify(cfg, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+				data, _ := io.ReadAll(r.Body)
+				gotBody = string(data)
+			})
+			req := httptest.NewRequest(http.MethodPost, "/user/provision/", strings.NewReader(tc.body))
+			req.Header = tc.header
+			rec := httptest.NewRecorder()
+			h(rec, req, nil)
+			if rec.Code != tc.want {
+				t.Errorf("status = %d, want %d", rec.Code, tc.want)
+			}
+			if tc.want == http.StatusOK && gotBody != tc.body {
+				t.Errorf("delegate got body %q, want %q", gotBody, tc.body)
+			}
+		})
+	}
+}